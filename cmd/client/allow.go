@@ -0,0 +1,185 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var blockedScrapeCounter = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "pushprox_client_blocked_scrapes_total",
+		Help: "Number of scrapes rejected because the target address is blocked",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(blockedScrapeCounter)
+}
+
+// errAddressBlocked is wrapped by the errors of dials to blocked addresses.
+var errAddressBlocked = errors.New("address is blocked")
+
+// metadataCIDRs are the link-local networks that cloud metadata services
+// such as 169.254.169.254 live in.
+var metadataCIDRs = []string{"169.254.0.0/16", "fe80::/10", "fd00:ec2::254/128"}
+
+// portRange is an inclusive range of ports.
+type portRange struct {
+	min, max int
+}
+
+// portMatcher is the set of ports the proxy may ask to scrape, nil allows
+// any port.
+type portMatcher []portRange
+
+// parsePortMatcher parses "*" or a comma separated list of ports and port
+// ranges such as "9100,9256,9300-9310".
+func parsePortMatcher(s string) (portMatcher, error) {
+	if s == "*" {
+		return nil, nil
+	}
+	var m portMatcher
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		lo, hi := entry, entry
+		if i := strings.Index(entry, "-"); i >= 0 {
+			lo, hi = entry[:i], entry[i+1:]
+		}
+		min, err := parsePort(lo)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q in %q", entry, s)
+		}
+		max, err := parsePort(hi)
+		if err != nil || max < min {
+			return nil, fmt.Errorf("invalid port %q in %q", entry, s)
+		}
+		m = append(m, portRange{min, max})
+	}
+	return m, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+	if port < 1 || port > 65535 {
+		return 0, fmt.Errorf("port %d out of range", port)
+	}
+	return port, nil
+}
+
+// allows reports whether the port may be scraped.
+func (m portMatcher) allows(port string) bool {
+	if m == nil {
+		return true
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return false
+	}
+	for _, r := range m {
+		if p >= r.min && p <= r.max {
+			return true
+		}
+	}
+	return false
+}
+
+// pathMatcher is the set of URL path globs the proxy may ask to scrape, nil
+// allows any path.
+type pathMatcher []string
+
+// parsePathMatcher parses "*" or a comma separated list of path.Match
+// patterns such as "/metrics,/probe*".
+func parsePathMatcher(s string) (pathMatcher, error) {
+	if s == "*" {
+		return nil, nil
+	}
+	var m pathMatcher
+	for _, pattern := range strings.Split(s, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if !strings.HasPrefix(pattern, "/") {
+			return nil, fmt.Errorf("invalid path %q in %q, paths must start with /", pattern, s)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid path %q in %q: %v", pattern, s, err)
+		}
+		m = append(m, pattern)
+	}
+	return m, nil
+}
+
+// allows reports whether the URL path may be scraped. Paths with dot or
+// empty segments are refused, as a target may resolve "/metrics/../admin"
+// to a path the patterns don't allow. A single trailing slash is fine.
+func (m pathMatcher) allows(p string) bool {
+	if m == nil {
+		return true
+	}
+	if p == "" {
+		p = "/"
+	}
+	if len(p) > 1 && path.Clean(p) != strings.TrimSuffix(p, "/") {
+		return false
+	}
+	for _, pattern := range m {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// addressBlocker rejects connections to addresses in any of its networks.
+type addressBlocker []*net.IPNet
+
+func parseAddressBlocker(cidrs []string) (addressBlocker, error) {
+	var b addressBlocker
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, network)
+	}
+	return b, nil
+}
+
+// control is a net.Dialer Control function. It sees the address actually
+// being connected to, after name resolution, so a target can't resolve to
+// an allowed address when checked and a blocked one when dialled.
+func (b addressBlocker) control(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	for _, n := range b {
+		if n.Contains(ip) {
+			return &scrapeError{http.StatusForbidden, fmt.Errorf("scrape target %s: %w", host, errAddressBlocked)}
+		}
+	}
+	return nil
+}
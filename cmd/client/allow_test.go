@@ -0,0 +1,119 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPortMatcher(t *testing.T) {
+	for _, tc := range []struct {
+		spec    string
+		allowed []string
+		denied  []string
+	}{
+		{spec: "*", allowed: []string{"1", "9100", "65535"}},
+		{spec: "9100", allowed: []string{"9100"}, denied: []string{"9101", "80", "abc"}},
+		{spec: "9100, 9256,9300-9310", allowed: []string{"9100", "9256", "9300", "9305", "9310"}, denied: []string{"9299", "9311", "9257"}},
+	} {
+		m, err := parsePortMatcher(tc.spec)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tc.spec, err)
+			continue
+		}
+		for _, port := range tc.allowed {
+			if !m.allows(port) {
+				t.Errorf("%s: expected port %s to be allowed", tc.spec, port)
+			}
+		}
+		for _, port := range tc.denied {
+			if m.allows(port) {
+				t.Errorf("%s: expected port %s to be denied", tc.spec, port)
+			}
+		}
+	}
+
+	for _, spec := range []string{"", "abc", "9100,", "0", "70000", "9310-9300", "9300-", "-9300"} {
+		if _, err := parsePortMatcher(spec); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+}
+
+func TestPathMatcher(t *testing.T) {
+	for _, tc := range []struct {
+		spec    string
+		allowed []string
+		denied  []string
+	}{
+		{spec: "*", allowed: []string{"", "/", "/metrics", "/a/b/c"}},
+		{spec: "/metrics", allowed: []string{"/metrics"}, denied: []string{"/", "/metrics/", "/admin"}},
+		{spec: "/metrics, /probe*,/exporters/*/metrics", allowed: []string{"/metrics", "/probe", "/probe_http", "/exporters/node/metrics"}, denied: []string{"/admin", "/exporters/node/admin"}},
+		{spec: "/", allowed: []string{"", "/"}, denied: []string{"/metrics"}},
+		{spec: "/metrics/*", allowed: []string{"/metrics/node", "/metrics/"}, denied: []string{"/metrics/..", "/metrics/../admin", "/metrics/.", "/metrics//node", "/metrics/node//"}},
+		{spec: "/metrics/", allowed: []string{"/metrics/"}, denied: []string{"/metrics", "/metrics//", "/metrics/./"}},
+		{spec: "/exporters/*/metrics", allowed: []string{"/exporters/node/metrics"}, denied: []string{"/exporters/../metrics"}},
+	} {
+		m, err := parsePathMatcher(tc.spec)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tc.spec, err)
+			continue
+		}
+		for _, p := range tc.allowed {
+			if !m.allows(p) {
+				t.Errorf("%s: expected path %q to be allowed", tc.spec, p)
+			}
+		}
+		for _, p := range tc.denied {
+			if m.allows(p) {
+				t.Errorf("%s: expected path %q to be denied", tc.spec, p)
+			}
+		}
+	}
+
+	for _, spec := range []string{"", "metrics", "/metrics,", "/[", "/metrics,/["} {
+		if _, err := parsePathMatcher(spec); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+}
+
+func TestAddressBlocker(t *testing.T) {
+	b, err := parseAddressBlocker(metadataCIDRs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for address, blocked := range map[string]bool{
+		"169.254.169.254:80":   true,
+		"[fd00:ec2::254]:80":   true,
+		"[fe80::1]:9100":       true,
+		"127.0.0.1:9100":       false,
+		"10.0.0.1:9100":        false,
+		"[2001:db8::1]:9100":   false,
+		"[fd00:ec2::255]:9100": false,
+	} {
+		err := b.control("tcp", address, nil)
+		if blocked && !errors.Is(err, errAddressBlocked) {
+			t.Errorf("%s: expected to be blocked, got %v", address, err)
+		}
+		if !blocked && err != nil {
+			t.Errorf("%s: expected to be allowed, got %v", address, err)
+		}
+	}
+
+	if _, err := parseAddressBlocker([]string{"10.0.0.0"}); err == nil {
+		t.Error("Expected an error for a network without a mask")
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var circuitStateGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "pushprox_client_circuit_state",
+		Help: "State of the circuit breaker of each scrape target, 0 closed, 1 open and 2 half-open",
+	},
+	[]string{"host"},
+)
+
+func init() {
+	prometheus.MustRegister(circuitStateGauge)
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+type circuit struct {
+	state    circuitState
+	failures int
+	openedAt time.Time
+}
+
+// circuitBreaker stops scraping a target after it fails maxFailures times
+// in a row. Once cooldown has passed a single scrape is let through to
+// probe the target, closing the circuit if it succeeds. A nil breaker lets
+// every scrape through.
+type circuitBreaker struct {
+	maxFailures int
+	cooldown    time.Duration
+	now         func() time.Time
+
+	mu sync.Mutex
+	// Targets that failed their last scrape, others are closed.
+	circuits map[string]*circuit
+}
+
+func newCircuitBreaker(maxFailures int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{maxFailures: maxFailures, cooldown: cooldown, now: time.Now, circuits: map[string]*circuit{}}
+}
+
+// allow reports whether target may be scraped. Scrapes it lets through
+// must be reported to done.
+func (b *circuitBreaker) allow(target string) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.circuits[target]
+	if !ok {
+		return true
+	}
+	switch c.state {
+	case circuitClosed:
+		return true
+	case circuitOpen:
+		if b.now().Sub(c.openedAt) < b.cooldown {
+			return false
+		}
+		b.setState(target, c, circuitHalfOpen)
+		return true
+	default:
+		// A probe is already running.
+		return false
+	}
+}
+
+// done records whether a scrape of target let through by allow failed.
+func (b *circuitBreaker) done(target string, failed bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.circuits[target]
+	if !failed {
+		if ok {
+			delete(b.circuits, target)
+			circuitStateGauge.WithLabelValues(target).Set(float64(circuitClosed))
+		}
+		return
+	}
+	if !ok {
+		c = &circuit{}
+		b.circuits[target] = c
+	}
+	c.failures++
+	if c.state == circuitHalfOpen || c.failures >= b.maxFailures {
+		c.openedAt = b.now()
+		b.setState(target, c, circuitOpen)
+	}
+}
+
+func (b *circuitBreaker) setState(target string, c *circuit, state circuitState) {
+	c.state = state
+	circuitStateGauge.WithLabelValues(target).Set(float64(state))
+}
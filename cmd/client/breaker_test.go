@@ -0,0 +1,71 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := newCircuitBreaker(2, 30*time.Second)
+	b.now = func() time.Time { return now }
+	state := func() float64 { return testutil.ToFloat64(circuitStateGauge.WithLabelValues("node1:9100")) }
+
+	b.done("node1:9100", true)
+	if !b.allow("node1:9100") {
+		t.Fatal("Expected the circuit to stay closed after one failure")
+	}
+	b.done("node1:9100", true)
+	if b.allow("node1:9100") || state() != float64(circuitOpen) {
+		t.Fatalf("Expected the circuit to open after two failures, got state %v", state())
+	}
+	if !b.allow("node2:9100") {
+		t.Error("Expected other targets to be scraped")
+	}
+
+	now = now.Add(30 * time.Second)
+	if !b.allow("node1:9100") || state() != float64(circuitHalfOpen) {
+		t.Fatalf("Expected a probe after the cooldown, got state %v", state())
+	}
+	if b.allow("node1:9100") {
+		t.Error("Expected a single probe while half-open")
+	}
+	b.done("node1:9100", true)
+	if b.allow("node1:9100") || state() != float64(circuitOpen) {
+		t.Fatalf("Expected a failed probe to open the circuit again, got state %v", state())
+	}
+
+	now = now.Add(30 * time.Second)
+	if !b.allow("node1:9100") {
+		t.Fatal("Expected a probe after the cooldown")
+	}
+	b.done("node1:9100", false)
+	if state() != float64(circuitClosed) {
+		t.Errorf("Expected a successful probe to close the circuit, got state %v", state())
+	}
+	b.done("node1:9100", true)
+	if !b.allow("node1:9100") {
+		t.Error("Expected failures to be counted afresh once closed")
+	}
+
+	var none *circuitBreaker
+	none.done("node1:9100", true)
+	if !none.allow("node1:9100") {
+		t.Error("Expected a nil breaker to allow every scrape")
+	}
+}
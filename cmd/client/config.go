@@ -0,0 +1,271 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var configFile = kingpin.Flag("config.file", "YAML file of flag values keyed by flag name, flags on the command line or in the environment take precedence. The retry and --allow-port flags are read from it again on SIGHUP").String()
+
+// reloadableFlags can be changed by reloading the config file, changes to
+// other flags only take effect on restart.
+var reloadableFlags = map[string]bool{
+	"allow-port":               true,
+	"proxy.retry.initial-wait": true,
+	"proxy.retry.max-wait":     true,
+	"proxy.retry.multiplier":   true,
+	"proxy.retry.jitter":       true,
+}
+
+var configReloadsCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "pushprox_client_config_reloads_total",
+		Help: "Number of config file reloads by result",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	configReloadsCounter.WithLabelValues("success")
+	configReloadsCounter.WithLabelValues("failure")
+	prometheus.MustRegister(configReloadsCounter)
+}
+
+// secretFlags point at secrets, only whether they are set is logged.
+var secretFlags = map[string]bool{
+	"token-path":                       true,
+	"oauth2.client-secret-file":        true,
+	"tls.key":                          true,
+	"proxy.tls.key":                    true,
+	"scrape.tls.key":                   true,
+	"metrics.tls.key":                  true,
+	"metrics.basic-auth-password-file": true,
+}
+
+// logFlags logs the resolved value of every flag. Flags changed from their
+// default are logged at info level, all of them at debug level.
+func logFlags(logger log.Logger, app *kingpin.Application) {
+	changed := []interface{}{"msg", "Effective configuration"}
+	all := []interface{}{"msg", "Effective configuration including defaults"}
+	for _, f := range app.Model().Flags {
+		value := f.Value.String()
+		isDefault := value == strings.Join(f.Default, ",")
+		if secretFlags[f.Name] {
+			if value == "" {
+				value = "<unset>"
+			} else {
+				value = "<set>"
+			}
+		}
+		all = append(all, f.Name, value)
+		if !isDefault {
+			changed = append(changed, f.Name, value)
+		}
+	}
+	level.Info(logger).Log(changed...)
+	level.Debug(logger).Log(all...)
+}
+
+// envarPrefix starts the name of the environment variable of every flag.
+const envarPrefix = "PUSHPROX_"
+
+var envarReplacer = regexp.MustCompile(`[^a-zA-Z0-9]+`)
+
+// envarName returns the environment variable that sets a flag, such as
+// PUSHPROX_PROXY_URL for --proxy-url.
+func envarName(flag string) string {
+	return envarPrefix + strings.ToUpper(envarReplacer.ReplaceAllString(flag, "_"))
+}
+
+// bindEnvars lets every flag be set by its environment variable, flags
+// on the command line take precedence. It must be called before parsing.
+func bindEnvars(app *kingpin.Application) {
+	for _, f := range app.Model().Flags {
+		app.GetFlag(f.Name).Envar(envarName(f.Name))
+	}
+}
+
+// explicitFlags are the flags given on the command line, they take
+// precedence over the config file.
+var explicitFlags = map[string]bool{}
+
+// trackExplicitFlags records the flags given on the command line in
+// explicitFlags, it must be called before parsing them.
+func trackExplicitFlags(app *kingpin.Application) {
+	for _, f := range app.Model().Flags {
+		name := f.Name
+		app.GetFlag(name).Action(func(*kingpin.ParseContext) error {
+			explicitFlags[name] = true
+			return nil
+		})
+	}
+}
+
+// readConfigFile returns the flag values set by a config file, leaving out
+// flags given on the command line or in the environment. A list sets a
+// repeatable flag once for each element.
+func readConfigFile(filename string) (map[string][]string, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	raw := map[string]interface{}{}
+	if err := yaml.Unmarshal(content, &raw); err != nil {
+		return nil, errors.Wrap(err, "config file is invalid")
+	}
+	values := make(map[string][]string, len(raw))
+	for name, v := range raw {
+		if kingpin.CommandLine.GetFlag(name) == nil || name == "config.file" {
+			return nil, fmt.Errorf("unknown flag %q in config file", name)
+		}
+		if _, ok := os.LookupEnv(envarName(name)); ok || explicitFlags[name] {
+			continue
+		}
+		if list, ok := v.([]interface{}); ok {
+			values[name] = []string{}
+			for _, e := range list {
+				values[name] = append(values[name], fmt.Sprint(e))
+			}
+			continue
+		}
+		values[name] = []string{fmt.Sprint(v)}
+	}
+	return values, nil
+}
+
+// setFlag sets a flag to the values given in the config file.
+func setFlag(name string, values []string) error {
+	value := kingpin.CommandLine.GetFlag(name).Model().Value
+	for _, v := range values {
+		if err := value.Set(v); err != nil {
+			return errors.Wrapf(err, "invalid value for %s in config file", name)
+		}
+	}
+	return nil
+}
+
+// loadConfigFile sets the flags given in the config file, if there is one,
+// and returns what it set.
+func loadConfigFile(filename string) (map[string][]string, error) {
+	if filename == "" {
+		return nil, nil
+	}
+	values, err := readConfigFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	for name, v := range values {
+		if err := setFlag(name, v); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// reloadConfig reads the config file again and applies the flags that can
+// be changed while running, nothing is changed if any of them is invalid.
+// loaded is what the file set at startup or the last reload, changes to
+// other flags are only warned about. A flag removed from the file keeps its
+// current value. It returns loaded updated with the file's values.
+func (c *Coordinator) reloadConfig(filename string, loaded map[string][]string, bo *reloadableBackOff) (map[string][]string, error) {
+	values, err := readConfigFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	for name, v := range values {
+		if !reloadableFlags[name] && !reflect.DeepEqual(v, loaded[name]) {
+			level.Warn(c.logger).Log("msg", "Config file change needs a restart to take effect", "flag", name)
+		}
+	}
+
+	previous := map[string]string{}
+	for name := range reloadableFlags {
+		previous[name] = kingpin.CommandLine.GetFlag(name).Model().Value.String()
+	}
+	restore := func() {
+		for name, v := range previous {
+			kingpin.CommandLine.GetFlag(name).Model().Value.Set(v)
+		}
+	}
+	for name := range reloadableFlags {
+		if v, ok := values[name]; ok {
+			if err := setFlag(name, v); err != nil {
+				restore()
+				return nil, err
+			}
+		}
+	}
+	ports, err := parsePortMatcher(*allowPort)
+	if err == nil && useLocalhost != nil && *useLocalhost && ports == nil {
+		err = errors.New("client must restrict access on localhost to specific ports")
+	}
+	if err != nil {
+		restore()
+		return nil, errors.Wrap(err, "--allow-port is invalid")
+	}
+	c.allowPorts.Store(ports)
+	bo.set(newBackOffFromFlags())
+
+	merged := make(map[string][]string, len(loaded)+len(values))
+	for name, v := range loaded {
+		merged[name] = v
+	}
+	for name, v := range values {
+		merged[name] = v
+	}
+	return merged, nil
+}
+
+// reloadableBackOff is a backoff that can be replaced while in use, the
+// replacement starts from its initial wait.
+type reloadableBackOff struct {
+	mu sync.Mutex
+	b  backoff.BackOff
+}
+
+func (r *reloadableBackOff) NextBackOff() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.b.NextBackOff()
+}
+
+func (r *reloadableBackOff) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.b.Reset()
+}
+
+func (r *reloadableBackOff) set(b backoff.BackOff) {
+	b.Reset()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.b = b
+}
@@ -0,0 +1,247 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/go-kit/kit/log"
+)
+
+func TestReloadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pushprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "config.yml")
+	defer func(port string, wait time.Duration) { *allowPort, *retryInitialWait = port, wait }(*allowPort, *retryInitialWait)
+
+	write := func(content string) {
+		if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("allow-port: 9100\nproxy-url:\n  - http://proxy/\n")
+	loaded, err := loadConfigFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *allowPort != "9100" {
+		t.Errorf("Expected allow-port 9100, got %s", *allowPort)
+	}
+
+	c := Coordinator{logger: &TestLogger{}}
+	bo := &reloadableBackOff{b: &backoff.ZeroBackOff{}}
+	write("allow-port: 9100-9110\nproxy.retry.initial-wait: 3s\nproxy-url:\n  - http://other/\n")
+	if _, err := c.reloadConfig(filename, loaded, bo); err != nil {
+		t.Fatal(err)
+	}
+	ports := c.allowPorts.Load().(portMatcher)
+	if !ports.allows("9105") || ports.allows("9200") {
+		t.Errorf("Expected ports 9100-9110 to be allowed, got %v", ports)
+	}
+	if wait := bo.NextBackOff(); wait < time.Second {
+		t.Errorf("Expected the reloaded initial wait, got %s", wait)
+	}
+
+	// An invalid file changes nothing.
+	write("allow-port: 9100\nproxy.retry.initial-wait: 1s\nproxy.retry.jitter: nope\n")
+	if _, err := c.reloadConfig(filename, loaded, bo); err == nil {
+		t.Error("Expected error for an invalid value, got none")
+	}
+	write("allow-port: nope\n")
+	if _, err := c.reloadConfig(filename, loaded, bo); err == nil {
+		t.Error("Expected error for an invalid port, got none")
+	}
+	if *allowPort != "9100-9110" || *retryInitialWait != 3*time.Second {
+		t.Errorf("Expected flags to be kept, got allow-port %s and initial wait %s", *allowPort, *retryInitialWait)
+	}
+	if ports := c.allowPorts.Load().(portMatcher); !ports.allows("9105") {
+		t.Errorf("Expected ports to be kept, got %v", ports)
+	}
+	write("unknown: 1\n")
+	if _, err := c.reloadConfig(filename, loaded, bo); err == nil {
+		t.Error("Expected error for an unknown flag, got none")
+	}
+}
+
+func TestReloadConfigRestartWarning(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pushprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "config.yml")
+	defer func(port string) { *allowPort = port }(*allowPort)
+
+	write := func(content string) {
+		if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("allow-port: 9100\nfqdn: client-a\n")
+	loaded, err := readConfigFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	warnings := 0
+	c := Coordinator{logger: log.LoggerFunc(func(keyvals ...interface{}) error {
+		for _, v := range keyvals {
+			if v == "Config file change needs a restart to take effect" {
+				warnings++
+			}
+		}
+		return nil
+	})}
+	bo := &reloadableBackOff{b: &backoff.ZeroBackOff{}}
+	for i, tc := range []struct {
+		content  string
+		warnings int
+	}{
+		{"allow-port: 9100\nfqdn: client-b\n", 1},
+		// The same file again isn't a change.
+		{"allow-port: 9100\nfqdn: client-b\n", 1},
+		// Neither is removing the flag, which keeps its value.
+		{"allow-port: 9100\n", 1},
+		{"allow-port: 9100\nfqdn: client-c\n", 2},
+	} {
+		write(tc.content)
+		if loaded, err = c.reloadConfig(filename, loaded, bo); err != nil {
+			t.Fatal(err)
+		}
+		if warnings != tc.warnings {
+			t.Errorf("Reload %d: expected %d restart warnings in total, got %d", i+1, tc.warnings, warnings)
+		}
+	}
+}
+
+func TestLoadConfigFilePrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pushprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "config.yml")
+	defer func(port, addr string) { *allowPort, *localhostAddr = port, addr }(*allowPort, *localhostAddr)
+	explicitFlags["allow-port"] = true
+	defer delete(explicitFlags, "allow-port")
+
+	*allowPort = "9100"
+	if err := ioutil.WriteFile(filename, []byte("allow-port: 9200\nlocalhost-addr: 127.0.0.2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfigFile(filename); err != nil {
+		t.Fatal(err)
+	}
+	if *allowPort != "9100" {
+		t.Errorf("Expected the command line allow-port 9100, got %s", *allowPort)
+	}
+	if *localhostAddr != "127.0.0.2" {
+		t.Errorf("Expected localhost-addr from the config file, got %s", *localhostAddr)
+	}
+
+	for _, content := range []string{"unknown: 1\n", "config.file: other.yml\n", "max-scrape-size: nope\n"} {
+		if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadConfigFile(filename); err == nil {
+			t.Errorf("%q: expected error, got none", content)
+		}
+	}
+}
+
+func TestLogFlags(t *testing.T) {
+	app := kingpin.New("test", "")
+	app.Flag("token-path", "").String()
+	app.Flag("tls.key", "").String()
+	app.Flag("fqdn", "").Default("host").String()
+	app.Flag("allow-port", "").Default("*").String()
+	if _, err := app.Parse([]string{"--token-path=/secret/token", "--allow-port=9100"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var lines []map[string]interface{}
+	logFlags(log.LoggerFunc(func(keyvals ...interface{}) error {
+		line := map[string]interface{}{}
+		for i := 0; i < len(keyvals); i += 2 {
+			line[fmt.Sprint(keyvals[i])] = fmt.Sprint(keyvals[i+1])
+		}
+		lines = append(lines, line)
+		return nil
+	}), app)
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %v", lines)
+	}
+	for i, expected := range []map[string]interface{}{
+		{"level": "info", "token-path": "<set>", "allow-port": "9100", "tls.key": nil, "fqdn": nil},
+		{"level": "debug", "token-path": "<set>", "allow-port": "9100", "tls.key": "<unset>", "fqdn": "host"},
+	} {
+		for k, v := range expected {
+			if lines[i][k] != v {
+				t.Errorf("Line %d: expected %s %v, got %v", i, k, v, lines[i][k])
+			}
+		}
+	}
+}
+
+func TestSecretFlags(t *testing.T) {
+	for _, f := range kingpin.CommandLine.Model().Flags {
+		name := f.Name
+		if strings.HasSuffix(name, "key") || strings.Contains(name, "secret") || strings.Contains(name, "password") || name == "token-path" {
+			if !secretFlags[name] {
+				t.Errorf("Expected --%s to be in secretFlags", name)
+			}
+		}
+	}
+}
+
+func TestBindEnvars(t *testing.T) {
+	if name := envarName("proxy.retry.max-wait"); name != "PUSHPROX_PROXY_RETRY_MAX_WAIT" {
+		t.Errorf("Expected PUSHPROX_PROXY_RETRY_MAX_WAIT, got %s", name)
+	}
+
+	os.Setenv("PUSHPROX_PROXY_URL", "http://env/")
+	defer os.Unsetenv("PUSHPROX_PROXY_URL")
+	os.Setenv("PUSHPROX_FQDN", "env")
+	defer os.Unsetenv("PUSHPROX_FQDN")
+
+	app := kingpin.New("test", "")
+	proxyURL := app.Flag("proxy-url", "").String()
+	fqdn := app.Flag("fqdn", "").Default("host").String()
+	allowPort := app.Flag("allow-port", "").Default("*").String()
+	bindEnvars(app)
+	if _, err := app.Parse([]string{"--fqdn=flag"}); err != nil {
+		t.Fatal(err)
+	}
+	if *proxyURL != "http://env/" {
+		t.Errorf("Expected proxy-url from the environment, got %s", *proxyURL)
+	}
+	if *fqdn != "flag" {
+		t.Errorf("Expected fqdn from the command line, got %s", *fqdn)
+	}
+	if *allowPort != "*" {
+		t.Errorf("Expected the default allow-port, got %s", *allowPort)
+	}
+}
@@ -15,17 +15,29 @@ package main
 
 import (
 	"bufio"
-	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"mime"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/http/pprof"
 	"net/url"
 	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
@@ -39,31 +51,118 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/common/promlog"
 	"github.com/prometheus/common/promlog/flag"
+	"github.com/rancher/pushprox"
 	"github.com/rancher/pushprox/util"
 )
 
 var (
 	myFqdn             = kingpin.Flag("fqdn", "FQDN to register with").Default(fqdn.Get()).String()
-	proxyURL           = kingpin.Flag("proxy-url", "Push proxy to talk to.").Required().String()
+	fqdnFromEnv        = kingpin.Flag("fqdn-from-env", "Environment variable to read the FQDN from instead of --fqdn, such as HOSTNAME").String()
+	proxyURLs          = kingpin.Flag("proxy-url", "Push proxy to talk to, repeat to fail over to the next proxy when one is unreachable.").Strings()
+	labels             = kingpin.Flag("label", "Label to register with the proxy, which lists it in /clients and as __meta_pushprox_label_<name> in /sd, may be repeated").PlaceHolder("<name>=<value>").StringMap()
+	userAgent          = kingpin.Flag("user-agent", "User-Agent of requests to the proxy and scrape targets, defaults to pushprox-client/<version> (<fqdn>)").String()
 	caCertFile         = kingpin.Flag("tls.cacert", "<file> CA certificate to verify peer against").String()
 	tlsCert            = kingpin.Flag("tls.cert", "<cert> Client certificate file").String()
 	tlsKey             = kingpin.Flag("tls.key", "<key> Private key file").String()
-	metricsAddr        = kingpin.Flag("metrics-addr", "Serve Prometheus metrics at this address").Default(":9369").String()
+	selfMetricsPath    = kingpin.Flag("self-metrics-path", "Serve the client's own metrics for scrapes of this path on the client's FQDN, whatever the port").String()
+	metricsAddr        = kingpin.Flag("metrics-addr", "Serve Prometheus metrics at this address, an empty address disables the metrics server").Default(":9369").String()
+	metricsServer      = kingpin.Flag("metrics-server", "Serve metrics, health and readiness at --metrics-addr, disable with --no-metrics-server").Default("true").Bool()
+	logAccess          = kingpin.Flag("log.access", "Log every completed scrape with its status, size and duration, combine with --log.format=json for structured logs").Default("false").Bool()
+	enablePprof        = kingpin.Flag("enable-pprof", "Serve Go profiling endpoints under /debug/pprof/ on the metrics address").Default("false").Bool()
 	tokenPath          = kingpin.Flag("token-path", "Uses an OAuth 2.0 Bearer token found in this path to make scrape requests").String()
+	tokenForceHTTPS    = kingpin.Flag("token.force-https", "Always scrape over https when a token is used").Default("true").Bool()
+	tokenAudience      = kingpin.Flag("token.audience", "Only use a token from --token-path that is a JWT for this audience, such as a projected Kubernetes service account token").String()
 	insecureSkipVerify = kingpin.Flag("insecure-skip-verify", "Disable SSL security checks for client").Default("false").Bool()
-	useLocalhost       = kingpin.Flag("use-localhost", "Use 127.0.0.1 to scrape metrics instead of FQDN").Default("false").Bool()
-	allowPort          = kingpin.Flag("allow-port", "Restricts the proxy to only being allowed to scrape the given port").Default("*").String()
+	useLocalhost       = kingpin.Flag("use-localhost", "Use --localhost-addr to scrape metrics instead of FQDN").Default("false").Bool()
+	localhostAddr      = kingpin.Flag("localhost-addr", "Address to scrape with --use-localhost, such as ::1 for IPv6").Default("127.0.0.1").String()
+	allowPort          = kingpin.Flag("allow-port", "Restricts the proxy to only being allowed to scrape the given ports, a comma separated list of ports and ranges such as 9100,9300-9310").Default("*").String()
+	verifyTargetFQDN   = kingpin.Flag("verify-target-fqdn", "Reject scrapes of hosts other than --fqdn").Default("true").Bool()
+	allowPath          = kingpin.Flag("allow-path", "Restricts the proxy to only being allowed to scrape the given URL paths, a comma separated list of globs such as /metrics,/probe*").Default("*").String()
 
+	metricsBasicAuthUser         = kingpin.Flag("metrics.basic-auth-user", "Require basic auth with this user for metrics and pprof").String()
+	metricsBasicAuthPasswordFile = kingpin.Flag("metrics.basic-auth-password-file", "<file> Password for --metrics.basic-auth-user").String()
+
+	blockPrivateMetadata = kingpin.Flag("block-private-metadata", "Refuse to scrape link-local addresses, where cloud metadata services live").Default("true").Bool()
+	blockedCIDRs         = kingpin.Flag("blocked-cidrs", "Comma separated networks to refuse to scrape, such as 10.0.0.0/8,192.168.0.0/16").String()
+
+	unixSockets   = kingpin.Flag("scrape.unix-socket", "Scrape targets on <port> over the Unix socket at <path> instead of TCP, may be repeated. --allow-port still applies to the port").PlaceHolder("<port>=<path>").StringMap()
+	scrapeTargets = kingpin.Flag("scrape.target", "Scrape <host:port> instead for scrapes of <port> or of paths starting with <path>, may be repeated. Ports win over paths and longer paths over shorter ones, --allow-port and --allow-path still apply to the scrape as made").PlaceHolder("<port>|<path>=<host:port>").StringMap()
+
+	defaultScrapeTimeout   = kingpin.Flag("scrape.default-timeout", "Timeout for scrape requests without a timeout header, 0 rejects them").Default("15s").Duration()
+	maxScrapeTimeout       = kingpin.Flag("scrape.max-timeout", "Clamp scrape timeouts sent by the proxy to this, 0 means no limit").Default("5m").Duration()
+	scrapeTimeoutOffset    = kingpin.Flag("scrape-timeout-offset", "Give up on scrapes this long before their timeout, leaving time to push the result or error before Prometheus gives up. Ignored for timeouts no longer than the offset").Default("500ms").Duration()
+	validateContentType    = kingpin.Flag("scrape.validate-content-type", "Push a 502 instead of successful scrape responses that aren't in a metrics format, such as HTML login pages").Default("false").Bool()
+	scrapeRetryInitialWait = kingpin.Flag("scrape.retry.initial-wait", "Amount of time to wait after the first refused or reset connection to the target, capped at --scrape.retry.max-wait").Default("100ms").Duration()
+	scrapeRetryMaxWait     = kingpin.Flag("scrape.retry.max-wait", "Retry scrapes whose connection to the target is refused or reset until the scrape deadline, waiting up to this long between attempts. 0 disables retries").Default("0").Duration()
+	maxScrapeSize          = kingpin.Flag("max-scrape-size", "Maximum size in bytes of a scrape response, larger responses are rejected (0 means no limit)").Default("0").Int64()
+	maxConcurrentScrapes   = kingpin.Flag("max-concurrent-scrapes", "Maximum number of scrapes to run at once, further scrapes are rejected (0 means no limit)").Default("0").Int()
+	maxTargetScrapes       = kingpin.Flag("max-scrapes-per-target", "Maximum number of scrapes to run at once against a single host:port, further scrapes get a 429 (0 means no limit)").Default("0").Int()
+
+	breakerFailures = kingpin.Flag("scrape.circuit-breaker.failures", "Push a 503 without scraping a host:port once this many scrapes of it failed in a row, 0 disables the circuit breaker").Default("0").Int()
+	breakerCooldown = kingpin.Flag("scrape.circuit-breaker.cooldown", "How long to stop scraping a failing host:port before trying a single scrape again").Default("30s").Duration()
+
+	watchdogTimeout = kingpin.Flag("watchdog.timeout", "Exit if no poll is started for this long, so a wedged client is restarted. Must exceed the longest poll, see --proxy.poll-timeout, and --proxy.retry.max-wait. 0 disables the watchdog").Default("0").Duration()
+
+	checkOnly = kingpin.Flag("check", "Check the configuration and that every --proxy-url can be reached, print a report and exit with 0 if all checks passed or 1 otherwise").Default("false").Bool()
+
+	oauth2TokenURL         = kingpin.Flag("oauth2.token-url", "Fetch scrape tokens from this OAuth 2.0 token endpoint with the client credentials grant").String()
+	oauth2ClientID         = kingpin.Flag("oauth2.client-id", "OAuth 2.0 client ID").String()
+	oauth2ClientSecretFile = kingpin.Flag("oauth2.client-secret-file", "File containing the OAuth 2.0 client secret").String()
+	oauth2Scopes           = kingpin.Flag("oauth2.scopes", "Comma separated OAuth 2.0 scopes to request").String()
+
+	minPollInterval  = kingpin.Flag("proxy.min-poll-interval", "Minimum time from the start of a successful poll to the next one, so a proxy answering polls straight away can't make the client spin. Also limits how often scrapes are picked up, 0 means no limit").Default("0").Duration()
+	proxyPollTimeout = kingpin.Flag("proxy.poll-timeout", "Poll again if the proxy sends no scrape request for this long, 0 means wait forever").Default("0").Duration()
+	proxyHTTPTimeout = kingpin.Flag("proxy.http-timeout", "Overall timeout for each poll and push request to the proxy, including the long poll wait. Must exceed the longest wait between scrapes, 0 means no timeout").Default("0").Duration()
 	retryInitialWait = kingpin.Flag("proxy.retry.initial-wait", "Amount of time to wait after proxy failure").Default("1s").Duration()
-	retryMaxWait     = kingpin.Flag("proxy.retry.max-wait", "Maximum amount of time to wait between proxy poll retries").Default("5s").Duration()
+	retryMaxWait     = kingpin.Flag("proxy.retry.max-wait", "Maximum amount of time to wait between proxy poll retries, before jitter").Default("5s").Duration()
+	retryMultiplier  = kingpin.Flag("proxy.retry.multiplier", "Factor to grow the wait by after each proxy failure").Default("1.5").Float64()
+	retryJitter      = kingpin.Flag("proxy.retry.jitter", "Randomize each wait by up to this fraction, so clients don't retry in lockstep").Default("0.5").Float64()
+
+	dialLocalAddr          = kingpin.Flag("dial.local-addr", "Local IP address, with an optional port, to connect to the proxy from").String()
+	dialKeepAlive          = kingpin.Flag("dial.keepalive", "Interval of TCP keep-alive probes on connections to the proxy, lower it below the idle timeout of NATs and firewalls on the way. Negative disables keep-alives").Default("30s").Duration()
+	proxyProtocol          = kingpin.Flag("proxy.send-proxy-protocol", "Send a PROXY protocol header of this version on connections to the proxy, for load balancers in front of it that require one").Enum("v1", "v2")
+	dialDualStack          = kingpin.Flag("dial.dual-stack", "Connect to the proxy over IPv6 or IPv4, disable with --no-dial.dual-stack to only look up and connect to IPv4 addresses").Default("true").Bool()
+	maxConnectAttempts     = kingpin.Flag("proxy.max-connect-attempts", "Exit after this many consecutive failed polls, so a misconfiguration shows up as a crash loop. 0 means retry forever").Default("0").Int()
+	proxyFailoverAfter     = kingpin.Flag("proxy.failover-after", "Number of consecutive failed polls after which to fail over to the next --proxy-url").Default("3").Int()
+	proxyHTTP2             = kingpin.Flag("proxy.http2", "Use HTTP/2 for an https proxy that supports it, falling back to HTTP/1.1 otherwise").Default("false").Bool()
+	proxyDisableKeepAlives = kingpin.Flag("proxy.disable-keepalives", "Open a new connection for every poll and push, so a load balancer can spread clients over proxy replicas at the cost of a connection setup per request").Default("false").Bool()
+
+	proxyTLSFlags  = newTLSFlags("proxy.tls.", "the proxy")
+	scrapeTLSFlags = newTLSFlags("scrape.tls.", "scrape targets")
+
+	transportMaxIdleConns        = kingpin.Flag("transport.max-idle-conns", "Maximum idle connections kept open across all hosts, 0 means no limit").Default("100").Int()
+	transportMaxIdleConnsPerHost = kingpin.Flag("transport.max-idle-conns-per-host", "Maximum idle connections kept open to each host, 0 means Go's default of 2").Default("0").Int()
+	transportIdleConnTimeout     = kingpin.Flag("transport.idle-conn-timeout", "How long idle connections are kept open, 0 means no limit").Default("90s").Duration()
+	transportTLSHandshakeTimeout = kingpin.Flag("transport.tls-handshake-timeout", "Maximum time to wait for a TLS handshake, 0 means no limit").Default("10s").Duration()
+
+	pushRetryInitialWait = kingpin.Flag("push.retry.initial-wait", "Amount of time to wait after the first failed push").Default("100ms").Duration()
+	pushRetryMaxWait     = kingpin.Flag("push.retry.max-wait", "Maximum amount of time to wait between push retries").Default("1s").Duration()
+	pushRetryMaxElapsed  = kingpin.Flag("push.retry.max-elapsed", "Give up retrying a push after this long, pushes are never retried past the scrape deadline").Default("5s").Duration()
+	pushCompress         = kingpin.Flag("push.compress", "Gzip scrape responses pushed to the proxy").Default("false").Bool()
+)
+
+const (
+	// How long to allow for pushing a failed scrape response once the
+	// scrape deadline has passed.
+	errorPushTimeout = 5 * time.Second
+	// How long to allow for deregistering from the proxy on shutdown.
+	deregisterTimeout = 5 * time.Second
+	// How long to allow for reaching each proxy with --check.
+	checkTimeout = 10 * time.Second
+	// Polls answered with a malformed scrape request are repeated straight
+	// away this many times in a row, then backed off like failed polls.
+	maxMalformedPolls = 3
+	// Scrape responses smaller than this aren't worth compressing.
+	pushCompressMinSize = 1024
 )
 
 var (
-	scrapeErrorCounter = prometheus.NewCounter(
+	scrapeErrorCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "pushprox_client_scrape_errors_total",
-			Help: "Number of scrape errors",
+			Help: "Number of scrape errors by reason",
 		},
+		[]string{"reason"},
 	)
 	pushErrorCounter = prometheus.NewCounter(
 		prometheus.CounterOpts{
@@ -71,58 +170,475 @@ var (
 			Help: "Number of push errors",
 		},
 	)
-	pollErrorCounter = prometheus.NewCounter(
+	pushResponsesCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pushprox_client_push_responses_total",
+			Help: "Number of push responses from the proxy by status code, pushes that got no response are counted as push errors",
+		},
+		[]string{"code"},
+	)
+	pollErrorCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "pushprox_client_poll_errors_total",
-			Help: "Number of poll errors",
+			Help: "Number of poll errors by reason",
+		},
+		[]string{"reason"},
+	)
+	inflightScrapes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "pushprox_client_inflight_scrapes",
+			Help: "Number of scrapes currently running",
+		},
+	)
+	pushBytesCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pushprox_client_push_bytes_total",
+			Help: "Number of scrape response body bytes streamed to the proxy",
+		},
+	)
+	malformedRequestsCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pushprox_client_malformed_scrape_requests_total",
+			Help: "Number of polls answered with a scrape request that couldn't be parsed",
+		},
+	)
+	scrapeTooLargeCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pushprox_client_scrape_too_large_total",
+			Help: "Number of scrape responses rejected for exceeding --max-scrape-size",
+		},
+	)
+	targetBusyCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pushprox_client_target_busy_total",
+			Help: "Number of scrapes rejected because --max-scrapes-per-target were already running against the target",
+		},
+		[]string{"host"},
+	)
+	negativeScrapeBudgetCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pushprox_client_negative_scrape_budget_total",
+			Help: "Number of pushes made after the scrape deadline had passed, whose remaining timeout was reported as 0",
+		},
+	)
+	pollCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pushprox_client_polls_total",
+			Help: "Number of successful polls",
+		},
+	)
+	pollIterationsCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pushprox_client_poll_iterations_total",
+			Help: "Number of polls started, successful or not. A rate far above the scrape rate means the client is spinning",
+		},
+	)
+	lastPollTimestamp = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "pushprox_client_last_successful_poll_timestamp_seconds",
+			Help: "Unix time of the last successful poll",
+		},
+	)
+	buildInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pushprox_client_build_info",
+			Help: "A metric with a constant '1' value labeled by version, revision, goversion and fqdn",
+		},
+		[]string{"version", "revision", "goversion", "fqdn"},
+	)
+	scrapeDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "pushprox_client_scrape_duration_seconds",
+			Help:    "Time taken to scrape a target and stream the response to the proxy",
+			Buckets: []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 20, 30},
 		},
+		[]string{"result"},
+	)
+	proxyRequestsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pushprox_client_proxy_requests_total",
+			Help: "Number of polls and pushes answered by the proxy, by negotiated protocol",
+		},
+		[]string{"protocol"},
+	)
+	activeProxyGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pushprox_client_active_proxy",
+			Help: "Whether a proxy URL is the one being polled",
+		},
+		[]string{"url"},
 	)
 )
 
 func init() {
-	prometheus.MustRegister(pushErrorCounter, pollErrorCounter, scrapeErrorCounter)
+	for _, reason := range []string{"dns", "timeout", "tls", "connrefused", "status", "other"} {
+		scrapeErrorCounter.WithLabelValues(reason)
+	}
+	for _, reason := range []string{"connection", "status", "read", "malformed", "canceled", "other"} {
+		pollErrorCounter.WithLabelValues(reason)
+	}
+	prometheus.MustRegister(pushErrorCounter, pushResponsesCounter, scrapeTooLargeCounter, negativeScrapeBudgetCounter, targetBusyCounter, pollErrorCounter, scrapeErrorCounter, inflightScrapes, pushBytesCounter, pollCounter, pollIterationsCounter, malformedRequestsCounter, lastPollTimestamp, buildInfo, scrapeDuration, proxyRequestsCounter, activeProxyGauge)
 }
 
+// newBackOffFromFlags returns the poll retry backoff. The wait is capped at
+// --proxy.retry.max-wait before jitter is applied, so a single wait can be
+// up to max-wait * (1 + jitter).
 func newBackOffFromFlags() backoff.BackOff {
+	b := newExponentialBackOff(*retryInitialWait, *retryMaxWait, 0)
+	b.Multiplier = *retryMultiplier
+	b.RandomizationFactor = *retryJitter
+	return b
+}
+
+func newPushBackOffFromFlags() backoff.BackOff {
+	return newExponentialBackOff(*pushRetryInitialWait, *pushRetryMaxWait, *pushRetryMaxElapsed)
+}
+
+func newScrapeBackOffFromFlags() backoff.BackOff {
+	// Only the scrape deadline limits the retries.
+	return newExponentialBackOff(*scrapeRetryInitialWait, *scrapeRetryMaxWait, 0)
+}
+
+// newExponentialBackOff returns a backoff waiting initial, growing to max,
+// and giving up after maxElapsed or never if it is 0. initial is capped at
+// max.
+func newExponentialBackOff(initial, max, maxElapsed time.Duration) *backoff.ExponentialBackOff {
 	b := backoff.NewExponentialBackOff()
-	b.InitialInterval = *retryInitialWait
-	b.Multiplier = 1.5
-	b.MaxInterval = *retryMaxWait
-	b.MaxElapsedTime = time.Duration(0)
+	b.InitialInterval = initial
+	if max > 0 && b.InitialInterval > max {
+		b.InitialInterval = max
+	}
+	b.MaxInterval = max
+	b.MaxElapsedTime = maxElapsed
+	b.Reset()
 	return b
 }
 
+// countingReader counts the bytes read from the wrapped body.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
 // Coordinator for scrape requests and responses
 type Coordinator struct {
 	logger log.Logger
+
+	// Proxy URLs to fail over between, poll and push paths are resolved
+	// against the active one.
+	proxyURLs []*url.URL
+	// Labels to register with, encoded for util.LabelsHeader.
+	labels string
+	// Index of the active proxy URL, accessed atomically.
+	activeProxy int32
+
+	// Slots for running scrapes, nil when unlimited.
+	scrapeSlots chan struct{}
+	// Running scrapes per target, nil when unlimited.
+	targetScrapes *targetLimiter
+	// Circuit breaker of failing targets, nil when disabled.
+	breaker *circuitBreaker
+
+	// Client for scrape requests, the one passed around is for the proxy.
+	scrapeClient *http.Client
+
+	// Token for scrape requests, nil if scrapes aren't authenticated.
+	token tokenSource
+
+	// Ports scrapes are allowed on, a portMatcher replaced by config
+	// reloads. Unset or nil allows any port.
+	allowPorts atomic.Value
+	// Paths scrapes are allowed on, nil allows any path.
+	allowPaths pathMatcher
+	// Local addresses scrapes are routed to, nil routes none.
+	targets *targetRouter
+
+	// Set to 1 by the first successful poll, accessed atomically.
+	polled int32
+	// Unix time in nanoseconds the last poll started, accessed atomically.
+	lastPollStart int64
+	// Consecutive polls answered with a malformed scrape request, only
+	// used by the poll loop.
+	malformedPolls int
+}
+
+// targetLimiter limits the scrapes running against each target.
+type targetLimiter struct {
+	limit int
+
+	mu      sync.Mutex
+	running map[string]int
+}
+
+func newTargetLimiter(limit int) *targetLimiter {
+	return &targetLimiter{limit: limit, running: map[string]int{}}
+}
+
+// acquire reports whether a scrape of target may start, and if so counts
+// it until release is called.
+func (l *targetLimiter) acquire(target string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.running[target] >= l.limit {
+		return false
+	}
+	l.running[target]++
+	return true
+}
+
+func (l *targetLimiter) release(target string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// Drop idle targets so the map only holds running scrapes.
+	if l.running[target]--; l.running[target] <= 0 {
+		delete(l.running, target)
+	}
+}
+
+// targetKey returns the host:port a scrape URL connects to, with the
+// scheme's default port filled in.
+func targetKey(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(strings.ToLower(u.Hostname()), port)
+}
+
+// tokenSource provides the bearer token attached to scrape requests.
+type tokenSource interface {
+	Get() (string, error)
+}
+
+// scrapeError is a scrape failure that is reported to the proxy with a
+// specific status code.
+type scrapeError struct {
+	code int
+	err  error
+}
+
+func (e *scrapeError) Error() string { return e.err.Error() }
+func (e *scrapeError) Unwrap() error { return e.err }
+
+// errMalformedPoll is returned for a poll answered with a malformed scrape
+// request that should be repeated straight away.
+var errMalformedPoll = errors.New("malformed scrape request")
+
+// pollError is a poll failure with the reason it is counted under.
+type pollError struct {
+	reason string
+	err    error
+}
+
+func (e *pollError) Error() string { return e.err.Error() }
+func (e *pollError) Unwrap() error { return e.err }
+
+// pollErrorReason returns the reason a poll failed for.
+func pollErrorReason(err error) string {
+	var pe *pollError
+	if errors.As(err, &pe) {
+		return pe.reason
+	}
+	if errors.Is(err, context.Canceled) {
+		return "canceled"
+	}
+	return "other"
+}
+
+// metricsContentTypes are the media types of the exposition formats.
+var metricsContentTypes = map[string]bool{
+	"text/plain":                      true,
+	"application/openmetrics-text":    true,
+	"application/vnd.google.protobuf": true,
+}
+
+// isMetricsContentType reports whether contentType is a metrics exposition
+// format, rather than say an HTML login page.
+func isMetricsContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && metricsContentTypes[mediaType]
 }
 
-func (c *Coordinator) handleErr(request *http.Request, client *http.Client, err error) {
-	level.Error(c.logger).Log("err", err)
-	scrapeErrorCounter.Inc()
+var errScrapeTooLarge = errors.New("scrape response exceeds --max-scrape-size")
+
+// sizeLimitedBody fails reads once more than the remaining number of bytes
+// have been read from the wrapped body.
+type sizeLimitedBody struct {
+	io.ReadCloser
+	remaining int64
+	exceeded  bool
+}
+
+func (b *sizeLimitedBody) Read(p []byte) (int, error) {
+	if b.exceeded {
+		return 0, errScrapeTooLarge
+	}
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) > b.remaining {
+		b.exceeded = true
+		return int(b.remaining), errScrapeTooLarge
+	}
+	b.remaining -= int64(n)
+	return n, err
+}
+
+// errorReason classifies a failed scrape for the scrape error counter.
+func errorReason(err error) string {
+	var (
+		se          *scrapeError
+		dnsErr      *net.DNSError
+		netErr      net.Error
+		unknownCA   x509.UnknownAuthorityError
+		invalidCert x509.CertificateInvalidError
+		hostnameErr x509.HostnameError
+		recordErr   tls.RecordHeaderError
+	)
+	switch {
+	case errors.As(err, &se):
+		// Rejected by the client itself with a specific status.
+		return "status"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connrefused"
+	case errors.As(err, &unknownCA), errors.As(err, &invalidCert), errors.As(err, &hostnameErr), errors.As(err, &recordErr):
+		return "tls"
+	}
+	return "other"
+}
+
+// normalizeFQDN trims surrounding space and a trailing dot from fqdn, and
+// checks the result is a valid hostname.
+func normalizeFQDN(fqdn string) (string, error) {
+	fqdn = strings.TrimSuffix(strings.TrimSpace(fqdn), ".")
+	if fqdn == "" {
+		return "", errors.New("FQDN is empty")
+	}
+	if len(fqdn) > 253 {
+		return "", fmt.Errorf("FQDN %q is longer than 253 characters", fqdn)
+	}
+	for _, label := range strings.Split(fqdn, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return "", fmt.Errorf("FQDN %q has a label that is empty or longer than 63 characters", fqdn)
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return "", fmt.Errorf("FQDN %q has a label starting or ending with a hyphen", fqdn)
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+				return "", fmt.Errorf("FQDN %q contains the invalid character %q", fqdn, r)
+			}
+		}
+	}
+	return fqdn, nil
+}
+
+// errorStatusCode picks the status pushed back to the proxy for a failed scrape.
+func errorStatusCode(err error) int {
+	var se *scrapeError
+	if errors.As(err, &se) {
+		return se.code
+	}
+	switch errorReason(err) {
+	case "timeout":
+		return http.StatusGatewayTimeout
+	case "dns", "connrefused":
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
+
+func (c *Coordinator) handleErr(logger log.Logger, request *http.Request, client *http.Client, err error) {
+	level.Error(logger).Log("err", err)
+	scrapeErrorCounter.WithLabelValues(errorReason(err)).Inc()
 	resp := &http.Response{
-		StatusCode: http.StatusInternalServerError,
+		StatusCode: errorStatusCode(err),
 		Body:       ioutil.NopCloser(strings.NewReader(err.Error())),
-		Header:     http.Header{},
+		Header:     http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+	}
+	ctx := request.Context()
+	if ctx.Err() != nil {
+		// The scrape deadline has already passed, but the proxy should
+		// still be told why, so push without it.
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.Background(), errorPushTimeout)
+		defer cancel()
 	}
-	if err = c.doPush(resp, request, client); err != nil {
+	if err = c.doPush(ctx, resp, request, client); err != nil {
 		pushErrorCounter.Inc()
-		level.Warn(c.logger).Log("msg", "Failed to push failed scrape response:", "err", err)
+		level.Warn(logger).Log("msg", "Failed to push failed scrape response:", "err", err)
 		return
 	}
-	level.Info(c.logger).Log("msg", "Pushed failed scrape response")
+	level.Info(logger).Log("msg", "Pushed failed scrape response")
 }
 
 func (c *Coordinator) doScrape(request *http.Request, client *http.Client) {
-	logger := log.With(c.logger, "scrape_id", request.Header.Get("id"))
+	traceparent := request.Header.Get("traceparent")
+	if !util.ValidTraceParent(traceparent) {
+		traceparent = util.NewTraceParent()
+		request.Header.Set("traceparent", traceparent)
+	}
+	logger := log.With(c.logger, "scrape_id", request.Header.Get("id"), "traceparent", traceparent)
+	var (
+		start     = time.Now()
+		status    int
+		pushed    int64
+		scrapeErr error
+	)
+	if *logAccess {
+		defer func() {
+			level.Info(logger).Log("msg", "Scrape completed", "url", request.URL, "status", status, "bytes", pushed, "duration_ms", time.Since(start).Milliseconds(), "err", scrapeErr)
+		}()
+	}
+	fail := func(err error) {
+		status, scrapeErr = errorStatusCode(err), err
+		c.handleErr(logger, request, client, err)
+	}
+	if c.scrapeSlots != nil {
+		select {
+		case c.scrapeSlots <- struct{}{}:
+			defer func() { <-c.scrapeSlots }()
+		default:
+			fail(&scrapeError{http.StatusServiceUnavailable, fmt.Errorf("too many concurrent scrapes, limit is %d", cap(c.scrapeSlots))})
+			return
+		}
+	}
+	inflightScrapes.Inc()
+	defer inflightScrapes.Dec()
+
 	timeout, err := util.GetHeaderTimeout(request.Header)
+	if errors.Is(err, util.ErrMissingTimeout) && *defaultScrapeTimeout > 0 {
+		timeout, err = *defaultScrapeTimeout, nil
+	}
 	if err != nil {
-		c.handleErr(request, client, err)
+		fail(err)
 		return
 	}
+	if *maxScrapeTimeout > 0 && timeout > *maxScrapeTimeout {
+		level.Warn(logger).Log("msg", "Clamping scrape timeout to --scrape.max-timeout", "timeout", timeout, "max_timeout", *maxScrapeTimeout)
+		timeout = *maxScrapeTimeout
+		// Targets that read the header get the clamped timeout too.
+		request.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", strconv.FormatFloat(timeout.Seconds(), 'f', -1, 64))
+	}
 	ctx, cancel := context.WithTimeout(request.Context(), timeout)
 	defer cancel()
 	request = request.WithContext(ctx)
+	scrapeCtx, scrapeCancel := context.WithTimeout(ctx, scrapeTimeout(timeout))
+	defer scrapeCancel()
 	// We cannot handle https requests at the proxy, as we would only
 	// see a CONNECT, so use a URL parameter to trigger it.
 	params := request.URL.Query()
@@ -132,40 +648,113 @@ func (c *Coordinator) doScrape(request *http.Request, client *http.Client) {
 		request.URL.RawQuery = params.Encode()
 	}
 
-	if *tokenPath != "" {
-		token, err := ioutil.ReadFile(*tokenPath)
+	if c.token != nil {
+		token, err := c.token.Get()
 		if err != nil {
-			c.handleErr(request, client, fmt.Errorf("cannot read token from token-path"))
+			fail(err)
 			return
 		}
 		request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
-		request.URL.Scheme = "https"
+		if *tokenForceHTTPS {
+			request.URL.Scheme = "https"
+		}
+	}
+
+	if *verifyTargetFQDN && request.URL.Hostname() != *myFqdn {
+		fail(&scrapeError{http.StatusForbidden, errors.New("scrape target doesn't match client fqdn")})
+		return
 	}
 
-	if request.URL.Hostname() != *myFqdn {
-		c.handleErr(request, client, errors.New("scrape target doesn't match client fqdn"))
+	// The client's own metrics are served from memory, so the port and
+	// localhost flags don't apply to them.
+	selfScrape := *selfMetricsPath != "" && request.URL.Path == *selfMetricsPath && request.URL.Hostname() == *myFqdn
+	if !selfScrape && !c.allowPaths.allows(request.URL.Path) {
+		fail(&scrapeError{http.StatusForbidden, fmt.Errorf("client does not have permissions to scrape path %s", request.URL.Path)})
 		return
 	}
 
 	port := request.URL.Port()
-	if len(port) > 0 {
-		if *allowPort != "*" && *allowPort != port {
-			c.handleErr(request, client, fmt.Errorf("client does not have permissions to scrape port %s", port))
+	if len(port) > 0 && !selfScrape {
+		if allowPorts, _ := c.allowPorts.Load().(portMatcher); !allowPorts.allows(port) {
+			fail(&scrapeError{http.StatusForbidden, fmt.Errorf("client does not have permissions to scrape port %s", port)})
 			return
 		}
 		if useLocalhost != nil && *useLocalhost {
-			request.URL.Host = fmt.Sprintf("127.0.0.1:%s", port)
+			request.URL.Host = net.JoinHostPort(*localhostAddr, port)
+		}
+	}
+	if addr, ok := c.targets.route(request.URL); ok && !selfScrape {
+		request.URL.Host = addr
+	}
+
+	target := targetKey(request.URL)
+	if c.targetScrapes != nil && !selfScrape {
+		if !c.targetScrapes.acquire(target) {
+			targetBusyCounter.WithLabelValues(target).Inc()
+			fail(&scrapeError{http.StatusTooManyRequests, fmt.Errorf("too many concurrent scrapes of %s, limit is %d", target, c.targetScrapes.limit)})
+			return
 		}
+		defer c.targetScrapes.release(target)
+	}
+	if !selfScrape && !c.breaker.allow(target) {
+		fail(&scrapeError{http.StatusServiceUnavailable, fmt.Errorf("not scraping %s, its circuit breaker is open after repeated failures", target)})
+		return
 	}
 
-	scrapeResp, err := client.Do(request)
+	// The URL may have been rewritten by --use-localhost or --scrape.target.
+	level.Debug(logger).Log("msg", "Scraping target", "url", request.URL)
+	scrapeStart := time.Now()
+	var scrapeResp *http.Response
+	if selfScrape {
+		scrapeResp = selfMetrics(request)
+	} else {
+		scrapeResp, err = c.scrapeWithRetry(targetRequest(scrapeCtx, request))
+		c.breaker.done(target, err != nil)
+	}
 	if err != nil {
+		scrapeDuration.WithLabelValues("error").Observe(time.Since(scrapeStart).Seconds())
+		if errors.Is(err, errAddressBlocked) {
+			// Counted here rather than when dialling, which may happen
+			// for several addresses and retries of one scrape.
+			blockedScrapeCounter.Inc()
+		}
 		msg := fmt.Sprintf("failed to scrape %s", request.URL.String())
-		c.handleErr(request, client, errors.Wrap(err, msg))
+		fail(errors.Wrap(err, msg))
 		return
 	}
+	defer scrapeResp.Body.Close()
 	level.Info(logger).Log("msg", "Retrieved scrape response")
-	if err = c.doPush(scrapeResp, request, client); err != nil {
+	if *validateContentType && scrapeResp.StatusCode/100 == 2 && !isMetricsContentType(scrapeResp.Header.Get("Content-Type")) {
+		scrapeDuration.WithLabelValues("error").Observe(time.Since(scrapeStart).Seconds())
+		fail(&scrapeError{http.StatusBadGateway, fmt.Errorf("scrape response has Content-Type %q, which isn't a metrics format", scrapeResp.Header.Get("Content-Type"))})
+		return
+	}
+	var limitedBody *sizeLimitedBody
+	if *maxScrapeSize > 0 {
+		if scrapeResp.ContentLength > *maxScrapeSize {
+			scrapeDuration.WithLabelValues("error").Observe(time.Since(scrapeStart).Seconds())
+			scrapeTooLargeCounter.Inc()
+			fail(&scrapeError{http.StatusRequestEntityTooLarge, errScrapeTooLarge})
+			return
+		}
+		limitedBody = &sizeLimitedBody{ReadCloser: scrapeResp.Body, remaining: *maxScrapeSize}
+		scrapeResp.Body = limitedBody
+	}
+	body := &countingReader{ReadCloser: scrapeResp.Body}
+	scrapeResp.Body = body
+	err = c.doPush(request.Context(), scrapeResp, request, client)
+	status, pushed, scrapeErr = scrapeResp.StatusCode, body.n, err
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	scrapeDuration.WithLabelValues(result).Observe(time.Since(scrapeStart).Seconds())
+	if err != nil {
+		if limitedBody != nil && limitedBody.exceeded {
+			scrapeTooLargeCounter.Inc()
+			fail(&scrapeError{http.StatusRequestEntityTooLarge, errScrapeTooLarge})
+			return
+		}
 		pushErrorCounter.Inc()
 		level.Warn(logger).Log("msg", "Failed to push scrape response:", "err", err)
 		return
@@ -173,62 +762,274 @@ func (c *Coordinator) doScrape(request *http.Request, client *http.Client) {
 	level.Info(logger).Log("msg", "Pushed scrape result")
 }
 
-// Report the result of the scrape back up to the proxy.
-func (c *Coordinator) doPush(resp *http.Response, origRequest *http.Request, client *http.Client) error {
-	resp.Header.Set("id", origRequest.Header.Get("id")) // Link the request and response
-	// Remaining scrape deadline.
-	deadline, _ := origRequest.Context().Deadline()
-	resp.Header.Set("X-Prometheus-Scrape-Timeout", fmt.Sprintf("%f", float64(time.Until(deadline))/1e9))
+// hopHeaders are the hop-by-hop headers of RFC 7230, which only apply to the
+// connection they came in on.
+var hopHeaders = []string{"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade"}
 
-	base, err := url.Parse(*proxyURL)
-	if err != nil {
-		return err
+// targetRequest returns the request to send to the target for a scrape
+// request from the proxy. Other headers are passed on, but not the proxy's
+// id or hop-by-hop headers.
+func targetRequest(ctx context.Context, request *http.Request) *http.Request {
+	r := request.Clone(ctx)
+	for _, v := range r.Header["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			r.Header.Del(strings.TrimSpace(name))
+		}
 	}
-	u, err := url.Parse("push")
-	if err != nil {
+	for _, name := range hopHeaders {
+		r.Header.Del(name)
+	}
+	r.Header.Del("Id")
+	return r
+}
+
+// scrapeTimeout returns how long a scrape with the given timeout may take,
+// reserving --scrape-timeout-offset to push its result.
+func scrapeTimeout(timeout time.Duration) time.Duration {
+	if *scrapeTimeoutOffset <= 0 || *scrapeTimeoutOffset >= timeout {
+		return timeout
+	}
+	return timeout - *scrapeTimeoutOffset
+}
+
+// scrapeWithRetry does the scrape, retrying connection failures with waits
+// of up to --scrape.retry.max-wait until the scrape deadline. Other errors
+// and every response, whatever its status, are returned straight away.
+func (c *Coordinator) scrapeWithRetry(request *http.Request) (*http.Response, error) {
+	if *scrapeRetryMaxWait <= 0 {
+		return c.scrapeClient.Do(request)
+	}
+	var (
+		resp    *http.Response
+		lastErr error
+	)
+	op := func() error {
+		resp, lastErr = c.scrapeClient.Do(request)
+		if lastErr != nil && !errors.Is(lastErr, syscall.ECONNREFUSED) && !errors.Is(lastErr, syscall.ECONNRESET) {
+			return backoff.Permanent(lastErr)
+		}
+		return lastErr
+	}
+	if err := backoff.Retry(op, backoff.WithContext(newScrapeBackOffFromFlags(), request.Context())); err != nil {
+		// Report why the target couldn't be scraped rather than that
+		// the deadline passed while retrying.
+		if lastErr != nil {
+			return nil, lastErr
+		}
+		return nil, err
+	}
+	return resp, nil
+}
+
+// checkRedirect holds redirects of a scrape to --allow-path and --allow-port,
+// so a target can't send the client somewhere it may not scrape.
+func (c *Coordinator) checkRedirect(request *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	if !c.allowPaths.allows(request.URL.Path) {
+		return &scrapeError{http.StatusForbidden, fmt.Errorf("client does not have permissions to scrape path %s", request.URL.Path)}
+	}
+	// Unlike the scrape URL, a redirect without a port goes to the
+	// scheme's default port, which has to be allowed as well.
+	_, port, _ := net.SplitHostPort(targetKey(request.URL))
+	if allowPorts, _ := c.allowPorts.Load().(portMatcher); !allowPorts.allows(port) {
+		return &scrapeError{http.StatusForbidden, fmt.Errorf("client does not have permissions to scrape port %s", port)}
+	}
+	return nil
+}
+
+// selfMetrics returns the client's own metrics as the response to request.
+func selfMetrics(request *http.Request) *http.Response {
+	rec := httptest.NewRecorder()
+	promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{}).ServeHTTP(rec, request)
+	return rec.Result()
+}
+
+// proxyEndpoint resolves an endpoint path against the proxy URL.
+func (c *Coordinator) proxyEndpoint(path string) *url.URL {
+	return c.proxyURLs[atomic.LoadInt32(&c.activeProxy)].ResolveReference(&url.URL{Path: path})
+}
+
+// setActiveProxy makes the proxy URL at index i the one talked to.
+func (c *Coordinator) setActiveProxy(i int) {
+	atomic.StoreInt32(&c.activeProxy, int32(i))
+	for j, u := range c.proxyURLs {
+		value := 0.0
+		if j == i {
+			value = 1
+		}
+		activeProxyGauge.WithLabelValues(u.String()).Set(value)
+	}
+}
+
+// failover switches to the next proxy URL. Scrapes already polled from the
+// failing proxy push to the new one, which is no worse as the failing proxy
+// would most likely not take their pushes either.
+func (c *Coordinator) failover() {
+	next := (int(atomic.LoadInt32(&c.activeProxy)) + 1) % len(c.proxyURLs)
+	level.Warn(c.logger).Log("msg", "Failing over to the next proxy", "proxy_url", c.proxyURLs[next])
+	c.setActiveProxy(next)
+}
+
+// scrapeBudget returns the seconds left until deadline, or 0 once it has
+// passed, counting the scrapes that overran it.
+func scrapeBudget(deadline time.Time) float64 {
+	left := time.Until(deadline)
+	if left < 0 {
+		negativeScrapeBudgetCounter.Inc()
+		return 0
+	}
+	return left.Seconds()
+}
+
+// Report the result of the scrape back up to the proxy. The push is bounded
+// by ctx, which may outlive the deadline of origRequest.
+func (c *Coordinator) doPush(ctx context.Context, resp *http.Response, origRequest *http.Request, client *http.Client) error {
+	resp.Header.Set("id", origRequest.Header.Get("id")) // Link the request and response
+	// Remaining scrape deadline, if the scrape got as far as having one.
+	if deadline, ok := origRequest.Context().Deadline(); ok {
+		resp.Header.Set("X-Prometheus-Scrape-Timeout", fmt.Sprintf("%f", scrapeBudget(deadline)))
+	}
+
+	// A failed push can only be retried while none of the body has been
+	// streamed, and only until the scrape deadline passes.
+	body := &countingReader{ReadCloser: resp.Body}
+	resp.Body = body
+	op := func() error {
+		err := c.pushOnce(ctx, resp, client, origRequest.Header.Get("traceparent"))
+		if err != nil && body.n > 0 {
+			return backoff.Permanent(err)
+		}
 		return err
 	}
-	url := base.ResolveReference(u)
+	err := backoff.Retry(op, backoff.WithContext(newPushBackOffFromFlags(), ctx))
+	pushBytesCounter.Add(float64(body.n))
+	return err
+}
+
+// pushOnce makes a single attempt at streaming resp to the proxy.
+func (c *Coordinator) pushOnce(ctx context.Context, resp *http.Response, client *http.Client, traceparent string) error {
+	url := c.proxyEndpoint("push")
 
-	buf := &bytes.Buffer{}
-	resp.Write(buf)
+	// Stream the response to the proxy rather than buffering it.
+	pr, pw := io.Pipe()
+	written := make(chan error, 1)
+	// Bodies of unknown length are assumed to be worth compressing.
+	compress := *pushCompress && (resp.ContentLength < 0 || resp.ContentLength >= pushCompressMinSize)
+	go func() {
+		var err error
+		if compress {
+			gz := gzip.NewWriter(pw)
+			err = resp.Write(gz)
+			if closeErr := gz.Close(); err == nil {
+				err = closeErr
+			}
+		} else {
+			err = resp.Write(pw)
+		}
+		pw.CloseWithError(err)
+		written <- err
+	}()
 	request := &http.Request{
-		Method:        "POST",
-		URL:           url,
-		Body:          ioutil.NopCloser(buf),
-		ContentLength: int64(buf.Len()),
+		Method:           "POST",
+		URL:              url,
+		Header:           http.Header{},
+		Body:             pr,
+		TransferEncoding: []string{"chunked"},
+	}
+	if traceparent != "" {
+		request.Header.Set("traceparent", traceparent)
+	}
+	if compress {
+		request.Header.Set("Content-Encoding", "gzip")
 	}
-	request = request.WithContext(origRequest.Context())
-	if _, err = client.Do(request); err != nil {
+	request = request.WithContext(ctx)
+	pushResp, err := client.Do(request)
+	// The transport consumes or closes the body before it is done with
+	// the request, so the writer cannot block here.
+	<-written
+	if err != nil {
 		return err
 	}
+	proxyRequestsCounter.WithLabelValues(pushResp.Proto).Inc()
+	pushResponsesCounter.WithLabelValues(strconv.Itoa(pushResp.StatusCode)).Inc()
+	// Drain the body so the connection can be reused.
+	io.Copy(ioutil.Discard, pushResp.Body)
+	pushResp.Body.Close()
+	if pushResp.StatusCode/100 != 2 {
+		return fmt.Errorf("proxy rejected push with status %s", pushResp.Status)
+	}
 	return nil
 }
 
-func (c *Coordinator) doPoll(client *http.Client) error {
-	base, err := url.Parse(*proxyURL)
-	if err != nil {
-		level.Error(c.logger).Log("msg", "Error parsing url:", "err", err)
-		return errors.Wrap(err, "error parsing url")
+func (c *Coordinator) doPoll(ctx context.Context, client *http.Client) error {
+	pollCtx := ctx
+	if *proxyPollTimeout > 0 {
+		var cancel context.CancelFunc
+		pollCtx, cancel = context.WithTimeout(ctx, *proxyPollTimeout)
+		defer cancel()
+	}
+	// No scrape request within the poll timeout is not an error, the
+	// client simply polls again.
+	noWork := func() bool {
+		return ctx.Err() == nil && errors.Is(pollCtx.Err(), context.DeadlineExceeded)
 	}
-	u, err := url.Parse("poll")
+
+	url := c.proxyEndpoint("poll")
+	pollRequest, err := http.NewRequestWithContext(pollCtx, "POST", url.String(), strings.NewReader(*myFqdn))
 	if err != nil {
-		level.Error(c.logger).Log("msg", "Error parsing url:", "err", err)
-		return errors.Wrap(err, "error parsing url poll")
+		return errors.Wrap(err, "error creating poll request")
+	}
+	if c.labels != "" {
+		pollRequest.Header.Set(util.LabelsHeader, c.labels)
 	}
-	url := base.ResolveReference(u)
-	resp, err := client.Post(url.String(), "", strings.NewReader(*myFqdn))
+	resp, err := client.Do(pollRequest)
 	if err != nil {
+		if noWork() {
+			level.Debug(c.logger).Log("msg", "No scrape request within the poll timeout")
+			return nil
+		}
 		level.Error(c.logger).Log("msg", "Error polling:", "err", err)
-		return errors.Wrap(err, "error polling")
+		reason := "connection"
+		if ctx.Err() != nil {
+			reason = "canceled"
+		}
+		return &pollError{reason, errors.Wrap(err, "error polling")}
 	}
 	defer resp.Body.Close()
+	proxyRequestsCounter.WithLabelValues(resp.Proto).Inc()
+	if resp.StatusCode/100 != 2 {
+		level.Error(c.logger).Log("msg", "Proxy rejected poll", "status", resp.Status)
+		return &pollError{"status", fmt.Errorf("proxy rejected poll with status %s", resp.Status)}
+	}
 
 	request, err := http.ReadRequest(bufio.NewReader(resp.Body))
 	if err != nil {
+		if noWork() {
+			level.Debug(c.logger).Log("msg", "No scrape request within the poll timeout")
+			c.malformedPolls = 0
+			return nil
+		}
 		level.Error(c.logger).Log("msg", "Error reading request:", "err", err)
-		return errors.Wrap(err, "error reading request")
+		var netErr net.Error
+		switch {
+		case ctx.Err() != nil:
+			return &pollError{"canceled", errors.Wrap(err, "error reading request")}
+		case errors.As(err, &netErr):
+			return &pollError{"read", errors.Wrap(err, "error reading request")}
+		}
+		// The proxy is reachable, so poll again straight away rather
+		// than backing off, unless whatever answers keeps sending
+		// garbage.
+		malformedRequestsCounter.Inc()
+		c.malformedPolls++
+		if c.malformedPolls >= maxMalformedPolls {
+			return &pollError{"malformed", errors.Wrapf(err, "%d malformed scrape requests in a row", c.malformedPolls)}
+		}
+		return errMalformedPoll
 	}
+	c.malformedPolls = 0
 	level.Info(c.logger).Log("msg", "Got scrape request", "scrape_id", request.Header.Get("id"), "url", request.URL)
 
 	request.RequestURI = ""
@@ -238,97 +1039,592 @@ func (c *Coordinator) doPoll(client *http.Client) error {
 	return nil
 }
 
-func (c *Coordinator) loop(bo backoff.BackOff, client *http.Client) {
+// loop polls the proxy for scrape requests until ctx is cancelled, or it
+// gives up after --proxy.max-connect-attempts consecutive failed polls.
+func (c *Coordinator) loop(ctx context.Context, bo backoff.BackOff, client *http.Client) error {
+	// Consecutive failed polls, to give up after --proxy.max-connect-attempts.
+	failedPolls := 0
+	var (
+		gaveUp    error
+		pollStart time.Time
+	)
 	op := func() error {
-		return c.doPoll(client)
+		pollStart = time.Now()
+		atomic.StoreInt64(&c.lastPollStart, pollStart.UnixNano())
+		pollIterationsCounter.Inc()
+		err := c.doPoll(ctx, client)
+		if errors.Is(err, errMalformedPoll) {
+			// Polled again straight away, but not a successful poll.
+			return nil
+		}
+		if err != nil {
+			failedPolls++
+			if *maxConnectAttempts > 0 && failedPolls >= *maxConnectAttempts {
+				gaveUp = errors.Wrapf(err, "giving up after %d consecutive failed polls", failedPolls)
+				return backoff.Permanent(gaveUp)
+			}
+			return err
+		}
+		failedPolls = 0
+		pollCounter.Inc()
+		lastPollTimestamp.SetToCurrentTime()
+		atomic.StoreInt32(&c.polled, 1)
+		return nil
 	}
 
-	for {
-		if err := backoff.RetryNotify(op, bo, func(err error, _ time.Duration) {
-			pollErrorCounter.Inc()
-		}); err != nil {
+	// RetryNotify resets bo on every call, so each successful poll starts
+	// retrying from the initial wait again.
+	for ctx.Err() == nil {
+		failures := 0
+		err := backoff.RetryNotify(op, backoff.WithContext(bo, ctx), func(err error, _ time.Duration) {
+			pollErrorCounter.WithLabelValues(pollErrorReason(err)).Inc()
+			failures++
+			if len(c.proxyURLs) > 1 && failures >= *proxyFailoverAfter {
+				c.failover()
+				failures = 0
+			}
+		})
+		// The last failure isn't passed to notify.
+		if err != nil {
+			pollErrorCounter.WithLabelValues(pollErrorReason(err)).Inc()
+		}
+		if gaveUp != nil {
+			return gaveUp
+		}
+		if err != nil && ctx.Err() == nil {
 			level.Error(c.logger).Log("err", err)
 		}
+		// Failed polls are spaced out by bo.
+		if wait := *minPollInterval - time.Since(pollStart); err == nil && wait > 0 {
+			level.Debug(c.logger).Log("msg", "Delaying the next poll for --proxy.min-poll-interval", "wait", wait)
+			select {
+			case <-ctx.Done():
+			case <-time.After(wait):
+			}
+		}
+	}
+	return nil
+}
+
+// watchdog calls exit if no poll was started within timeout, checking until
+// ctx is done.
+func (c *Coordinator) watchdog(ctx context.Context, timeout time.Duration, exit func()) {
+	start := time.Now()
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		last := start
+		if n := atomic.LoadInt64(&c.lastPollStart); n > start.UnixNano() {
+			last = time.Unix(0, n)
+		}
+		if since := time.Since(last); since > timeout {
+			level.Error(c.logger).Log("msg", "No poll started within --watchdog.timeout, exiting", "last_poll_start", last, "timeout", timeout)
+			exit()
+			return
+		}
+	}
+}
+
+// deregister asks the proxy to forget this client. It is best effort, a
+// client that fails to deregister is expired by the proxy eventually.
+func (c *Coordinator) deregister(client *http.Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), deregisterTimeout)
+	defer cancel()
+	url := c.proxyEndpoint("deregister")
+	request, err := http.NewRequestWithContext(ctx, "POST", url.String(), strings.NewReader(*myFqdn))
+	if err != nil {
+		level.Warn(c.logger).Log("msg", "Failed to deregister from proxy:", "err", err)
+		return
+	}
+	resp, err := client.Do(request)
+	if err != nil {
+		level.Warn(c.logger).Log("msg", "Failed to deregister from proxy:", "err", err)
+		return
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		level.Warn(c.logger).Log("msg", "Proxy rejected deregistration", "status", resp.Status)
+		return
+	}
+	level.Info(c.logger).Log("msg", "Deregistered from proxy")
+}
+
+// check writes a PASS or FAIL line to w for the FQDN, the scrape token and
+// each proxy URL, and reports whether all of them passed. Proxies are
+// reached with a GET of /clients, which unlike a poll doesn't register the
+// client.
+func (c *Coordinator) check(client *http.Client, w io.Writer) bool {
+	ok := true
+	report := func(name string, err error) {
+		if err != nil {
+			fmt.Fprintf(w, "FAIL %s: %v\n", name, err)
+			ok = false
+			return
+		}
+		fmt.Fprintf(w, "PASS %s\n", name)
+	}
+	report(fmt.Sprintf("fqdn %s", *myFqdn), nil)
+	if c.token != nil {
+		_, err := c.token.Get()
+		report("scrape token", err)
+	}
+	for _, u := range c.proxyURLs {
+		report(fmt.Sprintf("proxy %s", u), checkProxy(client, u))
+	}
+	return ok
+}
+
+// checkProxy returns an error unless the proxy at baseURL answers a GET of
+// /clients with a 2xx.
+func checkProxy(client *http.Client, baseURL *url.URL) error {
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+	url := baseURL.ResolveReference(&url.URL{Path: "clients"})
+	request, err := http.NewRequestWithContext(ctx, "GET", url.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// listenMetrics opens the listener of the metrics server, serving TLS if
+// tlsConfig isn't nil. It returns nil if the server is disabled with
+// --no-metrics-server or an empty --metrics-addr, or with --check.
+func listenMetrics(tlsConfig *tls.Config) (net.Listener, error) {
+	if !*metricsServer || *metricsAddr == "" || *checkOnly {
+		return nil, nil
+	}
+	l, err := net.Listen("tcp", *metricsAddr)
+	if err != nil || tlsConfig == nil {
+		return l, err
+	}
+	return tls.NewListener(l, tlsConfig), nil
+}
+
+// metricsHandler serves the client's metrics, health and readiness, and
+// pprof if enabled. With a user, metrics and pprof require basic auth while
+// health and readiness stay open for probes.
+func (c *Coordinator) metricsHandler(user, password string) http.Handler {
+	protect := func(h http.Handler) http.Handler { return h }
+	if user != "" {
+		protect = func(h http.Handler) http.Handler { return basicAuth(user, password, h) }
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", protect(promhttp.Handler()))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "OK")
+	})
+	mux.HandleFunc("/readyz", c.handleReady)
+	if *enablePprof {
+		mux.Handle("/debug/pprof/", protect(http.HandlerFunc(pprof.Index)))
+		mux.Handle("/debug/pprof/cmdline", protect(http.HandlerFunc(pprof.Cmdline)))
+		mux.Handle("/debug/pprof/profile", protect(http.HandlerFunc(pprof.Profile)))
+		mux.Handle("/debug/pprof/symbol", protect(http.HandlerFunc(pprof.Symbol)))
+		mux.Handle("/debug/pprof/trace", protect(http.HandlerFunc(pprof.Trace)))
+	}
+	return mux
+}
+
+// basicAuth only passes on requests with the given credentials.
+func basicAuth(user, password string, next http.Handler) http.Handler {
+	// Hashing first keeps the comparison time independent of the lengths.
+	userHash, passwordHash := sha256.Sum256([]byte(user)), sha256.Sum256([]byte(password))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		gotUser, gotPassword := sha256.Sum256([]byte(u)), sha256.Sum256([]byte(p))
+		userOK := subtle.ConstantTimeCompare(gotUser[:], userHash[:]) == 1
+		passwordOK := subtle.ConstantTimeCompare(gotPassword[:], passwordHash[:]) == 1
+		if !ok || !userOK || !passwordOK {
+			w.Header().Set("WWW-Authenticate", `Basic realm="pushprox-client"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleReady reports ready once the client has polled the proxy.
+func (c *Coordinator) handleReady(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&c.polled) == 0 {
+		http.Error(w, "Not polled the proxy yet", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "OK")
+}
+
+// unixSocketDialer dials the Unix socket mapped to the port of addr, falling
+// back to dial for unmapped ports.
+func unixSocketDialer(sockets map[string]string, dial func(context.Context, string, string) (net.Conn, error)) func(context.Context, string, string) (net.Conn, error) {
+	var d net.Dialer
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if _, port, err := net.SplitHostPort(addr); err == nil {
+			if path, ok := sockets[port]; ok {
+				return d.DialContext(ctx, "unix", path)
+			}
+		}
+		return dial(ctx, network, addr)
+	}
+}
+
+// ipv4Dialer makes dial only use IPv4 for TCP, so only A records are looked
+// up for host names.
+func ipv4Dialer(dial func(context.Context, string, string) (net.Conn, error)) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if network == "tcp" {
+			network = "tcp4"
+		}
+		return dial(ctx, network, addr)
+	}
+}
+
+// newDialer returns a dialer that refuses to connect to addresses blocked by
+// blocker.
+func newDialer(blocker addressBlocker) *net.Dialer {
+	return &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		DualStack: true,
+		Control:   blocker.control,
 	}
 }
 
+// newProxyDialer returns the dialer for connections to the proxy, applying
+// the --dial.* flags.
+func newProxyDialer() (*net.Dialer, error) {
+	d := newDialer(nil)
+	d.KeepAlive = *dialKeepAlive
+	if *dialLocalAddr != "" {
+		localAddr := *dialLocalAddr
+		if net.ParseIP(localAddr) != nil {
+			localAddr = net.JoinHostPort(localAddr, "0")
+		}
+		addr, err := net.ResolveTCPAddr("tcp", localAddr)
+		if err != nil {
+			return nil, err
+		}
+		d.LocalAddr = addr
+	}
+	return d, nil
+}
+
+// newTransport returns a transport that refuses to connect to addresses
+// blocked by blocker. If any are blocked, HTTP_PROXY and HTTPS_PROXY are
+// ignored, as the blocker would only see the address of the HTTP proxy.
+func newTransport(tlsConfig *tls.Config, blocker addressBlocker) *http.Transport {
+	proxy := http.ProxyFromEnvironment
+	if len(blocker) > 0 {
+		proxy = nil
+	}
+	return &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           newDialer(blocker).DialContext,
+		MaxIdleConns:          *transportMaxIdleConns,
+		MaxIdleConnsPerHost:   *transportMaxIdleConnsPerHost,
+		IdleConnTimeout:       *transportIdleConnTimeout,
+		TLSHandshakeTimeout:   *transportTLSHandshakeTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       tlsConfig,
+	}
+}
+
+// newProxyTransport returns the transport for polls and pushes to the proxy,
+// applying the --dial.*, --proxy.* and PROXY protocol flags. Other requests,
+// such as for tokens, must not use it.
+func newProxyTransport(tlsConfig *tls.Config) (*http.Transport, error) {
+	t := newTransport(tlsConfig, nil)
+	d, err := newProxyDialer()
+	if err != nil {
+		return nil, err
+	}
+	t.DialContext = d.DialContext
+	if !*dialDualStack {
+		t.DialContext = ipv4Dialer(d.DialContext)
+	}
+	if *proxyProtocol != "" {
+		t.DialContext = proxyProtocolDialer(*proxyProtocol, t.DialContext)
+		// The header is meant for the proxy's load balancer, not for
+		// an HTTP proxy from the environment.
+		t.Proxy = nil
+	}
+	t.DisableKeepAlives = *proxyDisableKeepAlives
+	// Go only negotiates HTTP/2 by itself for transports with the default
+	// dialer and TLS config, so it has to be asked for here.
+	t.ForceAttemptHTTP2 = *proxyHTTP2
+	return t, nil
+}
+
+// userAgentTransport sets the User-Agent of every request it sends.
+type userAgentTransport struct {
+	userAgent string
+	next      http.RoundTripper
+}
+
+func (t *userAgentTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	// A RoundTripper mustn't modify the request it's given.
+	request = request.Clone(request.Context())
+	request.Header.Set("User-Agent", t.userAgent)
+	return t.next.RoundTrip(request)
+}
+
 func main() {
 	promlogConfig := promlog.Config{}
 	flag.AddFlags(kingpin.CommandLine, &promlogConfig)
 	kingpin.HelpFlag.Short('h')
+	bindEnvars(kingpin.CommandLine)
+	trackExplicitFlags(kingpin.CommandLine)
 	kingpin.Parse()
+	configValues, err := loadConfigFile(*configFile)
+	kingpin.FatalIfError(err, "Error loading --config.file")
 	logger := promlog.New(&promlogConfig)
+	logFlags(logger, kingpin.CommandLine)
 	coordinator := Coordinator{logger: logger}
+	if *fqdnFromEnv != "" {
+		*myFqdn = os.Getenv(*fqdnFromEnv)
+	}
+	*myFqdn, err = normalizeFQDN(*myFqdn)
+	if err != nil {
+		level.Error(coordinator.logger).Log("msg", "FQDN is invalid, set it with --fqdn or --fqdn-from-env", "err", err)
+		os.Exit(1)
+	}
+	buildInfo.WithLabelValues(pushprox.Version, pushprox.GitCommit, runtime.Version(), *myFqdn).Set(1)
+	coordinator.labels, err = util.EncodeLabels(*labels)
+	if err != nil {
+		level.Error(coordinator.logger).Log("msg", "--label is invalid", "err", err)
+		os.Exit(1)
+	}
+	if *userAgent == "" {
+		*userAgent = fmt.Sprintf("pushprox-client/%s (%s)", pushprox.Version, *myFqdn)
+	}
+	if *maxConcurrentScrapes > 0 {
+		coordinator.scrapeSlots = make(chan struct{}, *maxConcurrentScrapes)
+	}
+	if *maxTargetScrapes > 0 {
+		coordinator.targetScrapes = newTargetLimiter(*maxTargetScrapes)
+	}
+	if *breakerFailures > 0 {
+		coordinator.breaker = newCircuitBreaker(*breakerFailures, *breakerCooldown)
+	}
 
-	if *proxyURL == "" {
+	// --proxy-url can't be required of the command line as it may be given
+	// in the config file.
+	if len(*proxyURLs) == 0 {
 		level.Error(coordinator.logger).Log("msg", "--proxy-url flag must be specified.")
 		os.Exit(1)
 	}
-	// Make sure proxyURL ends with a single '/'
-	*proxyURL = strings.TrimRight(*proxyURL, "/") + "/"
-	level.Info(coordinator.logger).Log("msg", "URL and FQDN info", "proxy_url", *proxyURL, "fqdn", *myFqdn)
-
-	tlsConfig := &tls.Config{}
-	if *tlsCert != "" {
-		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+	for _, proxyURL := range *proxyURLs {
+		if proxyURL == "" {
+			level.Error(coordinator.logger).Log("msg", "--proxy-url flag must be specified.")
+			os.Exit(1)
+		}
+		// Make sure proxyURL ends with a single '/'
+		proxyURL = strings.TrimRight(proxyURL, "/") + "/"
+		level.Info(coordinator.logger).Log("msg", "URL and FQDN info", "proxy_url", proxyURL, "fqdn", *myFqdn)
+		baseURL, err := url.Parse(proxyURL)
 		if err != nil {
-			level.Error(coordinator.logger).Log("msg", "Certificate or Key is invalid", "err", err)
+			level.Error(coordinator.logger).Log("msg", "--proxy-url is invalid", "err", err)
 			os.Exit(1)
 		}
-
-		// Setup HTTPS client
-		tlsConfig.Certificates = []tls.Certificate{cert}
-
-		tlsConfig.BuildNameToCertificate()
+		coordinator.proxyURLs = append(coordinator.proxyURLs, baseURL)
 	}
+	coordinator.setActiveProxy(0)
 
-	if insecureSkipVerify != nil {
-		tlsConfig.InsecureSkipVerify = *insecureSkipVerify
+	if *tokenPath != "" {
+		token, err := newBearerToken(*tokenPath, *tokenAudience, coordinator.logger)
+		if err != nil {
+			level.Error(coordinator.logger).Log("msg", "Not able to use token file", "err", err)
+			os.Exit(1)
+		}
+		go token.watch()
+		coordinator.token = token
 	}
 
-	if *caCertFile != "" {
-		caCert, err := ioutil.ReadFile(*caCertFile)
+	// The proxy connection uses --proxy.tls.* if given, else --tls.*.
+	// Scrapes use --scrape.tls.* if given, else the proxy configuration.
+	proxyTLS := tlsFlags{caCert: caCertFile, cert: tlsCert, key: tlsKey, insecureSkipVerify: insecureSkipVerify}
+	if proxyTLSFlags.isSet() {
+		proxyTLS = proxyTLSFlags
+	}
+	tlsConfig, err := proxyTLS.config(coordinator.logger)
+	if err != nil {
+		level.Error(coordinator.logger).Log("msg", "Invalid proxy TLS configuration", "err", err)
+		os.Exit(1)
+	}
+	scrapeTLSConfig := tlsConfig
+	if scrapeTLSFlags.isSet() {
+		scrapeTLSConfig, err = scrapeTLSFlags.config(coordinator.logger)
 		if err != nil {
-			level.Error(coordinator.logger).Log("msg", "Not able to read cacert file", "err", err)
+			level.Error(coordinator.logger).Log("msg", "Invalid scrape TLS configuration", "err", err)
 			os.Exit(1)
 		}
-		caCertPool := x509.NewCertPool()
-		if ok := caCertPool.AppendCertsFromPEM(caCert); !ok {
-			level.Error(coordinator.logger).Log("msg", "Failed to use cacert file as ca certificate")
+	}
+	// Scrapes and token requests may share the proxy configuration, but not
+	// its server name.
+	tokenTLSConfig := tlsConfig
+	tlsConfig = withServerName(tlsConfig, *proxyTLSFlags.serverName)
+	scrapeTLSConfig = withServerName(scrapeTLSConfig, *scrapeTLSFlags.serverName)
+
+	var metricsPassword string
+	if *metricsBasicAuthUser != "" {
+		password, err := ioutil.ReadFile(*metricsBasicAuthPasswordFile)
+		if err != nil {
+			level.Error(coordinator.logger).Log("msg", "Not able to read --metrics.basic-auth-password-file", "err", err)
 			os.Exit(1)
 		}
-
-		tlsConfig.RootCAs = caCertPool
+		metricsPassword = strings.TrimSpace(string(password))
 	}
-
-	if *metricsAddr != "" {
+	metricsTLS, err := metricsTLSConfig()
+	if err != nil {
+		level.Error(coordinator.logger).Log("msg", "Invalid metrics TLS configuration", "err", err)
+		os.Exit(1)
+	}
+	metricsListener, err := listenMetrics(metricsTLS)
+	if err != nil {
+		level.Warn(coordinator.logger).Log("msg", "Not serving metrics", "err", err)
+	}
+	if metricsListener != nil {
 		go func() {
-			if err := http.ListenAndServe(*metricsAddr, promhttp.Handler()); err != nil {
-				level.Warn(coordinator.logger).Log("msg", "ListenAndServe", "err", err)
+			if err := http.Serve(metricsListener, coordinator.metricsHandler(*metricsBasicAuthUser, metricsPassword)); err != nil {
+				level.Warn(coordinator.logger).Log("msg", "Serve", "err", err)
 			}
 		}()
 	}
 
-	if useLocalhost != nil && *useLocalhost && *allowPort == "*" {
-		level.Error(coordinator.logger).Log("msg", "client must restrict access on localhost to a single port")
+	allowPorts, err := parsePortMatcher(*allowPort)
+	if err != nil {
+		level.Error(coordinator.logger).Log("msg", "--allow-port is invalid", "err", err)
+		os.Exit(1)
+	}
+	coordinator.allowPorts.Store(allowPorts)
+	coordinator.allowPaths, err = parsePathMatcher(*allowPath)
+	if err != nil {
+		level.Error(coordinator.logger).Log("msg", "--allow-path is invalid", "err", err)
+		os.Exit(1)
+	}
+	if net.ParseIP(*localhostAddr) == nil {
+		level.Error(coordinator.logger).Log("msg", "--localhost-addr must be an IP address", "addr", *localhostAddr)
+		os.Exit(1)
+	}
+	if useLocalhost != nil && *useLocalhost && allowPorts == nil {
+		level.Error(coordinator.logger).Log("msg", "client must restrict access on localhost to specific ports")
 		os.Exit(1)
 	}
 
-	transport := &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-			DualStack: true,
-		}).DialContext,
-		MaxIdleConns:          100,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-		TLSClientConfig:       tlsConfig,
+	var blockedCIDRList []string
+	if *blockPrivateMetadata {
+		blockedCIDRList = append(blockedCIDRList, metadataCIDRs...)
+	}
+	if *blockedCIDRs != "" {
+		blockedCIDRList = append(blockedCIDRList, strings.Split(*blockedCIDRs, ",")...)
+	}
+	blocker, err := parseAddressBlocker(blockedCIDRList)
+	if err != nil {
+		level.Error(coordinator.logger).Log("msg", "--blocked-cidrs is invalid", "err", err)
+		os.Exit(1)
 	}
 
-	client := &http.Client{Transport: transport}
+	proxyTransport, err := newProxyTransport(tlsConfig)
+	if err != nil {
+		level.Error(coordinator.logger).Log("msg", "--dial.local-addr is invalid", "err", err)
+		os.Exit(1)
+	}
+	client := &http.Client{Transport: &userAgentTransport{*userAgent, proxyTransport}, Timeout: *proxyHTTPTimeout}
+	for port := range *unixSockets {
+		if _, err := parsePort(port); err != nil {
+			level.Error(coordinator.logger).Log("msg", "--scrape.unix-socket is invalid", "port", port, "err", err)
+			os.Exit(1)
+		}
+	}
+	coordinator.targets, err = parseTargetRouter(*scrapeTargets)
+	if err != nil {
+		level.Error(coordinator.logger).Log("msg", "--scrape.target is invalid", "err", err)
+		os.Exit(1)
+	}
+	scrapeTransport := newTransport(scrapeTLSConfig, blocker)
+	if len(*unixSockets) > 0 {
+		scrapeTransport.DialContext = unixSocketDialer(*unixSockets, scrapeTransport.DialContext)
+	}
+	coordinator.scrapeClient = &http.Client{Transport: &userAgentTransport{*userAgent, scrapeTransport}, CheckRedirect: coordinator.checkRedirect}
 
-	coordinator.loop(newBackOffFromFlags(), client)
+	if *oauth2TokenURL != "" {
+		if *tokenPath != "" {
+			level.Error(coordinator.logger).Log("msg", "--token-path and --oauth2.token-url are mutually exclusive")
+			os.Exit(1)
+		}
+		if *oauth2ClientID == "" || *oauth2ClientSecretFile == "" {
+			level.Error(coordinator.logger).Log("msg", "--oauth2.token-url requires --oauth2.client-id and --oauth2.client-secret-file")
+			os.Exit(1)
+		}
+		var scopes []string
+		if *oauth2Scopes != "" {
+			scopes = strings.Split(*oauth2Scopes, ",")
+		}
+		coordinator.token = &clientCredentialsToken{
+			tokenURL:   *oauth2TokenURL,
+			clientID:   *oauth2ClientID,
+			secretFile: *oauth2ClientSecretFile,
+			scopes:     scopes,
+			client:     newTokenClient(tokenTLSConfig),
+			logger:     coordinator.logger,
+		}
+	}
+
+	if *checkOnly {
+		if !coordinator.check(client, os.Stdout) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-term
+		level.Info(coordinator.logger).Log("msg", "Received signal, shutting down", "signal", sig)
+		cancel()
+	}()
+
+	bo := &reloadableBackOff{b: newBackOffFromFlags()}
+	if *configFile != "" {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				values, err := coordinator.reloadConfig(*configFile, configValues, bo)
+				if err != nil {
+					level.Error(coordinator.logger).Log("msg", "Failed to reload config file, keeping the current config", "err", err)
+					configReloadsCounter.WithLabelValues("failure").Inc()
+					continue
+				}
+				configValues = values
+				level.Info(coordinator.logger).Log("msg", "Reloaded config file")
+				configReloadsCounter.WithLabelValues("success").Inc()
+			}
+		}()
+	}
+
+	if *watchdogTimeout > 0 {
+		go coordinator.watchdog(ctx, *watchdogTimeout, func() { os.Exit(1) })
+	}
+	if err := coordinator.loop(ctx, bo, client); err != nil {
+		level.Error(coordinator.logger).Log("msg", "Failed to reach the proxy, exiting", "err", err)
+		os.Exit(1)
+	}
+	coordinator.deregister(client)
+	level.Info(coordinator.logger).Log("msg", "Shutdown complete")
 }
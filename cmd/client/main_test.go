@@ -14,12 +14,35 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/cenkalti/backoff/v4"
+	"github.com/go-kit/kit/log"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rancher/pushprox/util"
 )
 
 type TestLogger struct{}
@@ -29,16 +52,46 @@ func (tl *TestLogger) Log(vars ...interface{}) error {
 	return nil
 }
 
+func parseURL(s string) *url.URL {
+	u, err := url.Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return u
+}
+
 func prepareTest() (*httptest.Server, Coordinator) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		fmt.Fprintln(w, "GET /index.html HTTP/1.0\n\nOK")
 	}))
-	c := Coordinator{logger: &TestLogger{}}
-	*proxyURL = ts.URL
+	c := Coordinator{logger: &TestLogger{}, proxyURLs: []*url.URL{parseURL(ts.URL)}, scrapeClient: ts.Client()}
 	return ts, c
 }
 
+// prepareProxy starts a fake proxy that hands every pushed scrape response
+// to the returned channel.
+func prepareProxy(t *testing.T) (*httptest.Server, chan *http.Response) {
+	pushed := make(chan *http.Response, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			// Aborted push, like the proxy don't pass it on.
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf)), nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		pushed <- resp
+	}))
+	return ts, pushed
+}
+
 func TestDoScrape(t *testing.T) {
 	ts, c := prepareTest()
 	defer ts.Close()
@@ -60,13 +113,1742 @@ func TestHandleErr(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	c.handleErr(req, ts.Client(), errors.New("test error"))
+	c.handleErr(c.logger, req, ts.Client(), errors.New("test error"))
+}
+
+func TestErrorReason(t *testing.T) {
+	for _, tc := range []struct {
+		err    error
+		reason string
+	}{
+		{&url.Error{Op: "Get", URL: "http://target", Err: &net.DNSError{Err: "no such host", Name: "target"}}, "dns"},
+		{&url.Error{Op: "Get", URL: "http://target", Err: context.DeadlineExceeded}, "timeout"},
+		{&url.Error{Op: "Get", URL: "http://target", Err: &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}}, "connrefused"},
+		{&url.Error{Op: "Get", URL: "https://target", Err: x509.UnknownAuthorityError{}}, "tls"},
+		{&scrapeError{http.StatusRequestEntityTooLarge, errScrapeTooLarge}, "status"},
+		{errors.New("test error"), "other"},
+	} {
+		if reason := errorReason(tc.err); reason != tc.reason {
+			t.Errorf("%v: expected reason %q, got %q", tc.err, tc.reason, reason)
+		}
+	}
+}
+
+func TestNormalizeFQDN(t *testing.T) {
+	for _, tc := range []struct {
+		fqdn, normalized string
+		err              bool
+	}{
+		{fqdn: "client.example.com", normalized: "client.example.com"},
+		{fqdn: " client.example.com.\n", normalized: "client.example.com"},
+		{fqdn: "Client-1", normalized: "Client-1"},
+		{fqdn: "", err: true},
+		{fqdn: ".", err: true},
+		{fqdn: "client..example.com", err: true},
+		{fqdn: "-client.example.com", err: true},
+		{fqdn: "client_1.example.com", err: true},
+		{fqdn: "client:9100", err: true},
+		{fqdn: strings.Repeat("a", 64) + ".example.com", err: true},
+	} {
+		normalized, err := normalizeFQDN(tc.fqdn)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%q: expected error, got none", tc.fqdn)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: expected no error, got %v", tc.fqdn, err)
+		} else if normalized != tc.normalized {
+			t.Errorf("%q: expected %q, got %q", tc.fqdn, tc.normalized, normalized)
+		}
+	}
+}
+
+func TestDoPollErrorReason(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, tc := range []struct {
+		ctx    context.Context
+		resp   *http.Response
+		reason string
+	}{
+		{ctx: context.Background(), reason: "connection"},
+		{ctx: canceled, reason: "canceled"},
+		{ctx: context.Background(), resp: &http.Response{StatusCode: http.StatusServiceUnavailable, Status: "503 Service Unavailable"}, reason: "status"},
+	} {
+		client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			if tc.resp == nil {
+				return nil, errors.New("connection refused")
+			}
+			tc.resp.Body = ioutil.NopCloser(strings.NewReader("garbage"))
+			return tc.resp, nil
+		})}
+		c := Coordinator{logger: &TestLogger{}, proxyURLs: []*url.URL{parseURL("http://proxy/")}}
+		err := c.doPoll(tc.ctx, client)
+		if reason := pollErrorReason(err); reason != tc.reason {
+			t.Errorf("Expected reason %s, got %s for %v", tc.reason, reason, err)
+		}
+	}
+	if reason := pollErrorReason(context.Canceled); reason != "canceled" {
+		t.Errorf("Expected reason canceled, got %s", reason)
+	}
+}
+
+func TestDoPollMalformedRequest(t *testing.T) {
+	client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("GET http://target/metrics HTTP/1.1\r\nHost"))}, nil
+	})}
+	c := Coordinator{logger: &TestLogger{}, proxyURLs: []*url.URL{parseURL("http://proxy/")}}
+	before := testutil.ToFloat64(malformedRequestsCounter)
+	if err := c.doPoll(context.Background(), client); err != errMalformedPoll {
+		t.Errorf("Expected errMalformedPoll so the poll is repeated straight away, got %v", err)
+	}
+	if got := testutil.ToFloat64(malformedRequestsCounter) - before; got != 1 {
+		t.Errorf("Expected 1 malformed request, got %v", got)
+	}
+}
+
+func TestLoopMalformedRequests(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	polls := 0
+	client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		io.Copy(ioutil.Discard, r.Body)
+		r.Body.Close()
+		polls++
+		if polls == 2*maxMalformedPolls {
+			cancel()
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("<html>Default backend</html>"))}, nil
+	})}
+	c := Coordinator{logger: &TestLogger{}, proxyURLs: []*url.URL{parseURL("http://proxy/")}}
+
+	bo := &recordingBackOff{BackOff: &backoff.ZeroBackOff{}}
+	c.loop(ctx, bo, client)
+
+	// The first malformed requests are polled again straight away, from
+	// then on every one is backed off, apart from the last, cancelled poll.
+	if len(bo.waits) != maxMalformedPolls {
+		t.Errorf("Expected %d backed off polls, got waits %v", maxMalformedPolls, bo.waits)
+	}
+	if atomic.LoadInt32(&c.polled) != 0 {
+		t.Error("Expected malformed requests not to count as successful polls")
+	}
+}
+
+func TestDoPollTimeout(t *testing.T) {
+	*proxyPollTimeout = 10 * time.Millisecond
+	defer func() { *proxyPollTimeout = 0 }()
+	client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		// The proxy has no work, so it never answers.
+		<-r.Context().Done()
+		return nil, r.Context().Err()
+	})}
+	c := Coordinator{logger: &TestLogger{}, proxyURLs: []*url.URL{parseURL("http://proxy/")}}
+	if err := c.doPoll(context.Background(), client); err != nil {
+		t.Errorf("Expected no error for a poll without work, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.doPoll(ctx, client); pollErrorReason(err) != "canceled" {
+		t.Errorf("Expected a canceled poll, got %v", err)
+	}
+}
+
+func TestDoPollLabels(t *testing.T) {
+	var got string
+	client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		io.Copy(ioutil.Discard, r.Body)
+		r.Body.Close()
+		got = r.Header.Get(util.LabelsHeader)
+		return nil, errors.New("no scrape")
+	})}
+	c := Coordinator{logger: &TestLogger{}, proxyURLs: []*url.URL{parseURL("http://proxy/")}, labels: "region=eu"}
+	c.doPoll(context.Background(), client)
+	if got != "region=eu" {
+		t.Errorf("Expected the poll to carry labels %q, got %q", "region=eu", got)
+	}
 }
 
 func TestLoop(t *testing.T) {
-	ts, c := prepareTest()
+	pushed := make(chan struct{}, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/push" {
+			io.Copy(ioutil.Discard, r.Body)
+			pushed <- struct{}{}
+			return
+		}
+		fmt.Fprintln(w, "GET /index.html HTTP/1.0\n\nOK")
+	}))
 	defer ts.Close()
-	if err := c.doPoll(ts.Client()); err != nil {
+	c := Coordinator{logger: &TestLogger{}, proxyURLs: []*url.URL{parseURL(ts.URL)}, scrapeClient: ts.Client()}
+	if err := c.doPoll(context.Background(), ts.Client()); err != nil {
+		t.Fatal(err)
+	}
+	// Wait for the failed scrape to be pushed, so it doesn't outlive the
+	// proxy and retry forever.
+	<-pushed
+}
+
+func TestDoScrapeTimeout(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer target.Close()
+
+	proxy, pushed := prepareProxy(t)
+	defer proxy.Close()
+
+	c := Coordinator{logger: &TestLogger{}, proxyURLs: []*url.URL{parseURL(proxy.URL)}, scrapeClient: target.Client()}
+	*myFqdn = "127.0.0.1"
+
+	req, err := http.NewRequest("GET", target.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "0.1")
+
+	start := time.Now()
+	c.doScrape(req, target.Client())
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected scrape to be cancelled at its deadline, took %s", elapsed)
+	}
+	select {
+	case resp := <-pushed:
+		if resp.StatusCode != http.StatusGatewayTimeout {
+			t.Errorf("Expected pushed status %d, got %d", http.StatusGatewayTimeout, resp.StatusCode)
+		}
+	default:
+		t.Error("Expected a pushed response")
+	}
+}
+
+func TestDoScrapeConnectionRefused(t *testing.T) {
+	target := httptest.NewServer(http.NotFoundHandler())
+	target.Close()
+
+	proxy, pushed := prepareProxy(t)
+	defer proxy.Close()
+
+	c := Coordinator{logger: &TestLogger{}, proxyURLs: []*url.URL{parseURL(proxy.URL)}, scrapeClient: http.DefaultClient}
+	*myFqdn = "127.0.0.1"
+
+	req, err := http.NewRequest("GET", target.URL, nil)
+	if err != nil {
 		t.Fatal(err)
 	}
+	req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+	req.Header.Set("id", "scrape-1")
+	c.doScrape(req, proxy.Client())
+	select {
+	case resp := <-pushed:
+		if resp.StatusCode != http.StatusBadGateway {
+			t.Errorf("Expected pushed status %d, got %d", http.StatusBadGateway, resp.StatusCode)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+			t.Errorf("Expected a plain text error, got Content-Type %q", ct)
+		}
+		if id := resp.Header.Get("id"); id != "scrape-1" {
+			t.Errorf("Expected id scrape-1, got %q", id)
+		}
+	default:
+		t.Error("Expected a pushed response")
+	}
+}
+
+func TestDoScrapeRetry(t *testing.T) {
+	defer func(d time.Duration) { *scrapeRetryMaxWait = d }(*scrapeRetryMaxWait)
+	*scrapeRetryMaxWait = 10 * time.Millisecond
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "up 1\n")
+	}))
+	defer target.Close()
+
+	proxy, pushed := prepareProxy(t)
+	defer proxy.Close()
+
+	attempts := 0
+	scrapeClient := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		attempts++
+		if attempts < 3 {
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+		}
+		return http.DefaultTransport.RoundTrip(r)
+	})}
+	c := Coordinator{logger: &TestLogger{}, proxyURLs: []*url.URL{parseURL(proxy.URL)}, scrapeClient: scrapeClient}
+	*myFqdn = "127.0.0.1"
+
+	req, err := http.NewRequest("GET", target.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+	req.Header.Set("id", "scrape-1")
+	c.doScrape(req, proxy.Client())
+	select {
+	case resp := <-pushed:
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected pushed status %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+	default:
+		t.Error("Expected a pushed response")
+	}
+	if attempts != 3 {
+		t.Errorf("Expected 3 scrape attempts, got %d", attempts)
+	}
+
+	// Responses are never retried, whatever their status.
+	attempts = 0
+	scrapeClient.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		attempts++
+		return &http.Response{StatusCode: http.StatusNotFound, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader("")), Request: r}, nil
+	})
+	c.doScrape(req, proxy.Client())
+	select {
+	case resp := <-pushed:
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected pushed status %d, got %d", http.StatusNotFound, resp.StatusCode)
+		}
+	default:
+		t.Error("Expected a pushed response")
+	}
+	if attempts != 1 {
+		t.Errorf("Expected 1 scrape attempt, got %d", attempts)
+	}
+}
+
+func TestDoScrapeTargetRoute(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "up 1\n")
+	}))
+	defer target.Close()
+
+	proxy, pushed := prepareProxy(t)
+	defer proxy.Close()
+
+	targets, err := parseTargetRouter(map[string]string{"/exporter": parseURL(target.URL).Host})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		mu        sync.Mutex
+		scrapeURL string
+	)
+	logger := log.LoggerFunc(func(keyvals ...interface{}) error {
+		mu.Lock()
+		defer mu.Unlock()
+		for i := 0; i+1 < len(keyvals); i += 2 {
+			if keyvals[i] == "msg" && keyvals[i+1] == "Scraping target" {
+				scrapeURL = fmt.Sprint(keyvals[len(keyvals)-1])
+			}
+		}
+		return nil
+	})
+	c := Coordinator{logger: logger, proxyURLs: []*url.URL{parseURL(proxy.URL)}, scrapeClient: target.Client(), targets: targets}
+	*myFqdn = "127.0.0.1"
+
+	// Nothing listens on port 1, so the scrape only succeeds if routed.
+	req, err := http.NewRequest("GET", "http://127.0.0.1:1/exporter/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+	c.doScrape(req, proxy.Client())
+	select {
+	case resp := <-pushed:
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected pushed status %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+	default:
+		t.Error("Expected a pushed response")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := target.URL + "/exporter/metrics"; scrapeURL != want {
+		t.Errorf("Expected the routed URL %q to be logged, got %q", want, scrapeURL)
+	}
+}
+
+func TestDoScrapeCircuitBreaker(t *testing.T) {
+	target := httptest.NewServer(http.NotFoundHandler())
+	target.Close()
+
+	proxy, pushed := prepareProxy(t)
+	defer proxy.Close()
+
+	attempts := 0
+	scrapeClient := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		attempts++
+		return http.DefaultTransport.RoundTrip(r)
+	})}
+	c := Coordinator{logger: &TestLogger{}, proxyURLs: []*url.URL{parseURL(proxy.URL)}, scrapeClient: scrapeClient, breaker: newCircuitBreaker(1, time.Hour)}
+	*myFqdn = "127.0.0.1"
+
+	for _, want := range []int{http.StatusBadGateway, http.StatusServiceUnavailable} {
+		req, err := http.NewRequest("GET", target.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+		c.doScrape(req, proxy.Client())
+		select {
+		case resp := <-pushed:
+			if resp.StatusCode != want {
+				t.Errorf("Expected pushed status %d, got %d", want, resp.StatusCode)
+			}
+		default:
+			t.Error("Expected a pushed response")
+		}
+	}
+	if attempts != 1 {
+		t.Errorf("Expected the open circuit to stop the second scrape, got %d attempts", attempts)
+	}
+}
+
+func TestDoScrapeForbiddenPath(t *testing.T) {
+	proxy, pushed := prepareProxy(t)
+	defer proxy.Close()
+
+	c := Coordinator{logger: &TestLogger{}, proxyURLs: []*url.URL{parseURL(proxy.URL)}, scrapeClient: proxy.Client(), allowPaths: pathMatcher{"/metrics"}}
+	*myFqdn = "127.0.0.1"
+
+	req, err := http.NewRequest("GET", proxy.URL+"/admin", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+	c.doScrape(req, proxy.Client())
+	select {
+	case resp := <-pushed:
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("Expected pushed status %d, got %d", http.StatusForbidden, resp.StatusCode)
+		}
+	default:
+		t.Error("Expected a pushed response")
+	}
+}
+
+func TestDoScrapeForbiddenPort(t *testing.T) {
+	proxy, pushed := prepareProxy(t)
+	defer proxy.Close()
+
+	c := Coordinator{logger: &TestLogger{}, proxyURLs: []*url.URL{parseURL(proxy.URL)}, scrapeClient: proxy.Client()}
+	c.allowPorts.Store(portMatcher{{9100, 9100}})
+	*myFqdn = "127.0.0.1"
+
+	req, err := http.NewRequest("GET", "http://127.0.0.1:9200/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+	c.doScrape(req, proxy.Client())
+	select {
+	case resp := <-pushed:
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("Expected pushed status %d, got %d", http.StatusForbidden, resp.StatusCode)
+		}
+	default:
+		t.Error("Expected a pushed response")
+	}
+}
+
+func TestDoScrapeForbiddenRedirect(t *testing.T) {
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Expected the redirect to another port not to be followed")
+	}))
+	defer other.Close()
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/metrics":
+			http.Redirect(w, r, "/admin", http.StatusFound)
+		case "/metrics/other":
+			http.Redirect(w, r, other.URL+"/metrics", http.StatusFound)
+		default:
+			t.Errorf("Expected the redirect to %s not to be followed", r.URL.Path)
+		}
+	}))
+	defer target.Close()
+
+	proxy, pushed := prepareProxy(t)
+	defer proxy.Close()
+
+	c := Coordinator{logger: &TestLogger{}, proxyURLs: []*url.URL{parseURL(proxy.URL)}, allowPaths: pathMatcher{"/metrics", "/metrics/other"}}
+	allowPorts, err := parsePortMatcher(parseURL(target.URL).Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.allowPorts.Store(allowPorts)
+	c.scrapeClient = &http.Client{CheckRedirect: c.checkRedirect}
+	*myFqdn = "127.0.0.1"
+
+	for _, path := range []string{"/metrics", "/metrics/other"} {
+		req, err := http.NewRequest("GET", target.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+		c.doScrape(req, proxy.Client())
+		select {
+		case resp := <-pushed:
+			if resp.StatusCode != http.StatusForbidden {
+				t.Errorf("%s: expected pushed status %d, got %d", path, http.StatusForbidden, resp.StatusCode)
+			}
+		default:
+			t.Errorf("%s: expected a pushed response", path)
+		}
+	}
+}
+
+func TestDoScrapeSelfMetrics(t *testing.T) {
+	proxy, pushed := prepareProxy(t)
+	defer proxy.Close()
+
+	// The scrape client is unset, so any attempt to scrape over the network panics.
+	c := Coordinator{logger: &TestLogger{}, proxyURLs: []*url.URL{parseURL(proxy.URL)}, allowPaths: pathMatcher{"/metrics"}}
+	ports, err := parsePortMatcher("9100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.allowPorts.Store(ports)
+	*myFqdn = "client"
+	*selfMetricsPath = "/pushprox-metrics"
+	defer func() { *selfMetricsPath = "" }()
+
+	req, err := http.NewRequest("GET", "http://client:9369/pushprox-metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+	c.doScrape(req, proxy.Client())
+	select {
+	case resp := <-pushed:
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "pushprox_client_") {
+			t.Errorf("Expected the client's metrics, got status %d and body %q", resp.StatusCode, body)
+		}
+	default:
+		t.Error("Expected a pushed response")
+	}
+}
+
+func TestDoScrapeValidateContentType(t *testing.T) {
+	proxy, pushed := prepareProxy(t)
+	defer proxy.Close()
+	*myFqdn = "127.0.0.1"
+	*validateContentType = true
+	defer func() { *validateContentType = false }()
+
+	for contentType, status := range map[string]int{
+		"text/plain; version=0.0.4; charset=utf-8":                   http.StatusOK,
+		"application/openmetrics-text; version=1.0.0; charset=utf-8": http.StatusOK,
+		"text/html; charset=utf-8":                                   http.StatusBadGateway,
+		"":                                                           http.StatusBadGateway,
+	} {
+		target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			fmt.Fprintln(w, "up 1")
+		}))
+		c := Coordinator{logger: &TestLogger{}, proxyURLs: []*url.URL{parseURL(proxy.URL)}, scrapeClient: target.Client()}
+		req, err := http.NewRequest("GET", target.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+		c.doScrape(req, proxy.Client())
+		target.Close()
+		select {
+		case resp := <-pushed:
+			if resp.StatusCode != status {
+				t.Errorf("%q: expected pushed status %d, got %d", contentType, status, resp.StatusCode)
+			}
+		default:
+			t.Errorf("%q: expected a pushed response", contentType)
+		}
+	}
+}
+
+func TestDoScrapeVerifyTargetFQDN(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "up 1")
+	}))
+	defer target.Close()
+
+	proxy, pushed := prepareProxy(t)
+	defer proxy.Close()
+
+	c := Coordinator{logger: &TestLogger{}, proxyURLs: []*url.URL{parseURL(proxy.URL)}, scrapeClient: target.Client()}
+	*myFqdn = "client"
+	defer func(v bool) { *verifyTargetFQDN = v }(*verifyTargetFQDN)
+
+	for verify, status := range map[bool]int{true: http.StatusForbidden, false: http.StatusOK} {
+		*verifyTargetFQDN = verify
+		req, err := http.NewRequest("GET", target.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+		c.doScrape(req, proxy.Client())
+		select {
+		case resp := <-pushed:
+			if resp.StatusCode != status {
+				t.Errorf("verify %v: expected pushed status %d, got %d", verify, status, resp.StatusCode)
+			}
+		default:
+			t.Errorf("verify %v: expected a pushed response", verify)
+		}
+	}
+}
+
+func TestDoScrapeBlockedAddress(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Expected the blocked target not to be scraped")
+	}))
+	defer target.Close()
+
+	proxy, pushed := prepareProxy(t)
+	defer proxy.Close()
+
+	blocker, err := parseAddressBlocker([]string{"127.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Coordinator{logger: &TestLogger{}, proxyURLs: []*url.URL{parseURL(proxy.URL)}, scrapeClient: &http.Client{Transport: newTransport(nil, blocker)}}
+	*myFqdn = "127.0.0.1"
+	*scrapeRetryMaxWait = 10 * time.Millisecond
+	defer func() { *scrapeRetryMaxWait = 0 }()
+	before := testutil.ToFloat64(blockedScrapeCounter)
+
+	req, err := http.NewRequest("GET", target.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+	c.doScrape(req, proxy.Client())
+	select {
+	case resp := <-pushed:
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("Expected pushed status %d, got %d", http.StatusForbidden, resp.StatusCode)
+		}
+	default:
+		t.Error("Expected a pushed response")
+	}
+	if got := testutil.ToFloat64(blockedScrapeCounter) - before; got != 1 {
+		t.Errorf("Expected the blocked scrape to be counted once, got %v", got)
+	}
+}
+
+func TestNewTransportEnvironmentProxy(t *testing.T) {
+	if newTransport(nil, nil).Proxy == nil {
+		t.Error("Expected HTTP_PROXY to be used without blocked addresses")
+	}
+	blocker, err := parseAddressBlocker(metadataCIDRs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newTransport(nil, blocker).Proxy != nil {
+		t.Error("Expected HTTP_PROXY to be ignored with blocked addresses")
+	}
+}
+
+func TestDoScrapeUseLocalhost(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "up 1")
+	}))
+	defer target.Close()
+
+	proxy, pushed := prepareProxy(t)
+	defer proxy.Close()
+
+	c := Coordinator{logger: &TestLogger{}, proxyURLs: []*url.URL{parseURL(proxy.URL)}, scrapeClient: target.Client()}
+	*myFqdn = "client"
+	*useLocalhost = true
+	*localhostAddr = "127.0.0.1"
+	defer func() { *useLocalhost = false }()
+
+	req, err := http.NewRequest("GET", "http://client:"+parseURL(target.URL).Port()+"/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+	c.doScrape(req, proxy.Client())
+	select {
+	case resp := <-pushed:
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected pushed status %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+	default:
+		t.Error("Expected a pushed response")
+	}
+}
+
+func TestDoScrapeUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pushprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "exporter.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "up 1")
+	})}
+	go target.Serve(l)
+	defer target.Close()
+
+	proxy, pushed := prepareProxy(t)
+	defer proxy.Close()
+
+	transport := newTransport(nil, nil)
+	transport.DialContext = unixSocketDialer(map[string]string{"9100": socket}, transport.DialContext)
+	c := Coordinator{logger: &TestLogger{}, proxyURLs: []*url.URL{parseURL(proxy.URL)}, scrapeClient: &http.Client{Transport: transport}}
+	*myFqdn = "client"
+
+	req, err := http.NewRequest("GET", "http://client:9100/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+	c.doScrape(req, proxy.Client())
+	select {
+	case resp := <-pushed:
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK || string(body) != "up 1\n" {
+			t.Errorf("Expected the socket's metrics, got status %d and body %q", resp.StatusCode, body)
+		}
+	default:
+		t.Error("Expected a pushed response")
+	}
+}
+
+func TestDoScrapeConcurrencyLimit(t *testing.T) {
+	proxy, pushed := prepareProxy(t)
+	defer proxy.Close()
+
+	c := Coordinator{logger: &TestLogger{}, proxyURLs: []*url.URL{parseURL(proxy.URL)}, scrapeClient: proxy.Client(), scrapeSlots: make(chan struct{}, 1)}
+	c.scrapeSlots <- struct{}{} // Simulate a scrape already in flight.
+
+	req, err := http.NewRequest("GET", proxy.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+	c.doScrape(req, proxy.Client())
+
+	select {
+	case resp := <-pushed:
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("Expected pushed status %d, got %d", http.StatusServiceUnavailable, resp.StatusCode)
+		}
+	default:
+		t.Error("Expected a pushed response")
+	}
+}
+
+func TestDoScrapeTargetLimit(t *testing.T) {
+	proxy, pushed := prepareProxy(t)
+	defer proxy.Close()
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "up 1\n")
+	}))
+	defer target.Close()
+
+	c := Coordinator{logger: &TestLogger{}, proxyURLs: []*url.URL{parseURL(proxy.URL)}, scrapeClient: target.Client(), targetScrapes: newTargetLimiter(1)}
+	*myFqdn = "127.0.0.1"
+
+	key := targetKey(parseURL(target.URL))
+	c.targetScrapes.acquire(key) // Simulate a scrape of the target already in flight.
+	before := testutil.ToFloat64(targetBusyCounter.WithLabelValues(key))
+
+	req, err := http.NewRequest("GET", target.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+	c.doScrape(req, proxy.Client())
+
+	select {
+	case resp := <-pushed:
+		if resp.StatusCode != http.StatusTooManyRequests {
+			t.Errorf("Expected pushed status %d, got %d", http.StatusTooManyRequests, resp.StatusCode)
+		}
+	default:
+		t.Error("Expected a pushed response")
+	}
+	if got := testutil.ToFloat64(targetBusyCounter.WithLabelValues(key)) - before; got != 1 {
+		t.Errorf("Expected 1 busy target rejection, got %v", got)
+	}
+
+	// Once the running scrape finishes the target can be scraped again.
+	c.targetScrapes.release(key)
+	c.doScrape(req, proxy.Client())
+	select {
+	case resp := <-pushed:
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected pushed status %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+	default:
+		t.Error("Expected a pushed response")
+	}
+}
+
+func TestTargetKey(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"http://Node1:9100/metrics", "node1:9100"},
+		{"http://node1/metrics", "node1:80"},
+		{"https://node1/metrics", "node1:443"},
+		{"http://[::1]:9100/metrics", "[::1]:9100"},
+	}
+	for _, test := range tests {
+		if got := targetKey(parseURL(test.url)); got != test.want {
+			t.Errorf("targetKey(%q) = %q, want %q", test.url, got, test.want)
+		}
+	}
+}
+
+func TestDoScrapeMaxSize(t *testing.T) {
+	proxy, pushed := prepareProxy(t)
+	defer proxy.Close()
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.(http.Flusher).Flush() // Force a response without Content-Length.
+		w.Write(bytes.Repeat([]byte("a"), 1024))
+	}))
+	defer target.Close()
+
+	c := Coordinator{logger: &TestLogger{}, proxyURLs: []*url.URL{parseURL(proxy.URL)}, scrapeClient: target.Client()}
+	*myFqdn = "127.0.0.1"
+	*maxScrapeSize = 100
+	defer func() { *maxScrapeSize = 0 }()
+
+	req, err := http.NewRequest("GET", target.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+	before := testutil.ToFloat64(scrapeTooLargeCounter)
+	c.doScrape(req, target.Client())
+	if got := testutil.ToFloat64(scrapeTooLargeCounter) - before; got != 1 {
+		t.Errorf("Expected 1 scrape counted as too large, got %v", got)
+	}
+
+	select {
+	case resp := <-pushed:
+		if resp.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected pushed status %d, got %d", http.StatusRequestEntityTooLarge, resp.StatusCode)
+		}
+	default:
+		t.Error("Expected a pushed response")
+	}
+}
+
+func BenchmarkDoPush(b *testing.B) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+	}))
+	defer proxy.Close()
+	c := Coordinator{logger: log.NewNopLogger(), proxyURLs: []*url.URL{parseURL(proxy.URL)}}
+	body := bytes.Repeat([]byte("a"), 50<<20)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req, err := http.NewRequest("GET", proxy.URL, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		resp := &http.Response{
+			StatusCode:    http.StatusOK,
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{},
+			Body:          ioutil.NopCloser(bytes.NewReader(body)),
+			ContentLength: int64(len(body)),
+		}
+		if err := c.doPush(req.Context(), resp, req, proxy.Client()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestDoPushClosesResponse(t *testing.T) {
+	for _, status := range []int{http.StatusOK, http.StatusInternalServerError} {
+		body := &closeRecorder{Reader: strings.NewReader("response")}
+		client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			io.Copy(ioutil.Discard, r.Body)
+			r.Body.Close()
+			return &http.Response{StatusCode: status, Status: http.StatusText(status), Body: body}, nil
+		})}
+		c := Coordinator{logger: &TestLogger{}, proxyURLs: []*url.URL{parseURL("http://proxy/")}}
+
+		req, err := http.NewRequest("GET", "http://target/metrics", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader("metrics"))}
+		err = c.doPush(req.Context(), resp, req, client)
+		if status == http.StatusOK && err != nil {
+			t.Errorf("Expected no error, got %v", err)
+		}
+		if status != http.StatusOK && err == nil {
+			t.Errorf("Expected error for status %d, got none", status)
+		}
+		if !body.closed {
+			t.Errorf("Expected push response body to be closed for status %d", status)
+		}
+	}
+}
+
+func TestDoPushResponseCodes(t *testing.T) {
+	for _, status := range []int{http.StatusOK, http.StatusUnauthorized, http.StatusRequestEntityTooLarge, http.StatusServiceUnavailable} {
+		client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			io.Copy(ioutil.Discard, r.Body)
+			r.Body.Close()
+			return &http.Response{StatusCode: status, Status: http.StatusText(status), Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+		})}
+		c := Coordinator{logger: &TestLogger{}, proxyURLs: []*url.URL{parseURL("http://proxy/")}}
+		counter := pushResponsesCounter.WithLabelValues(strconv.Itoa(status))
+		before := testutil.ToFloat64(counter)
+
+		req, err := http.NewRequest("GET", "http://target/metrics", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader("metrics"))}
+		c.doPush(req.Context(), resp, req, client)
+		if got := testutil.ToFloat64(counter) - before; got != 1 {
+			t.Errorf("Expected 1 push response with status %d, got %v", status, got)
+		}
+	}
+}
+
+func TestLoopShutdown(t *testing.T) {
+	deregistered := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/poll":
+			<-r.Context().Done() // Long poll that never gets a scrape.
+		case "/deregister":
+			fqdn, _ := ioutil.ReadAll(r.Body)
+			deregistered <- string(fqdn)
+		}
+	}))
+	defer ts.Close()
+	c := Coordinator{logger: &TestLogger{}, proxyURLs: []*url.URL{parseURL(ts.URL)}}
+	*myFqdn = "client"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		c.loop(ctx, backoff.NewExponentialBackOff(), ts.Client())
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected loop to return after cancellation")
+	}
+
+	c.deregister(ts.Client())
+	select {
+	case fqdn := <-deregistered:
+		if fqdn != "client" {
+			t.Errorf("Expected deregistration of client, got %q", fqdn)
+		}
+	default:
+		t.Error("Expected a deregistration")
+	}
+}
+
+func TestDoPushRetry(t *testing.T) {
+	*pushRetryMaxWait = 10 * time.Millisecond
+	*pushRetryMaxElapsed = time.Second
+	for _, consumeBody := range []bool{false, true} {
+		attempts := 0
+		client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			attempts++
+			if attempts == 1 {
+				if consumeBody {
+					io.Copy(ioutil.Discard, r.Body)
+				}
+				r.Body.Close()
+				return nil, errors.New("connection refused")
+			}
+			io.Copy(ioutil.Discard, r.Body)
+			r.Body.Close()
+			return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+		})}
+		c := Coordinator{logger: &TestLogger{}, proxyURLs: []*url.URL{parseURL("http://proxy/")}}
+
+		req, err := http.NewRequest("GET", "http://target/metrics", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader("metrics"))}
+		err = c.doPush(req.Context(), resp, req, client)
+		if consumeBody {
+			// The body is gone, so the push cannot be replayed.
+			if err == nil || attempts != 1 {
+				t.Errorf("Expected a single failed attempt, got %d attempts and error %v", attempts, err)
+			}
+		} else if err != nil || attempts != 2 {
+			t.Errorf("Expected success on the second attempt, got %d attempts and error %v", attempts, err)
+		}
+	}
+}
+
+func TestNewBackOffFromFlags(t *testing.T) {
+	*retryInitialWait = 2 * time.Second
+	*retryMaxWait = 30 * time.Second
+	*retryMultiplier = 2
+	*retryJitter = 0.2
+
+	b, ok := newBackOffFromFlags().(*backoff.ExponentialBackOff)
+	if !ok {
+		t.Fatal("Expected an exponential backoff")
+	}
+	if b.InitialInterval != 2*time.Second || b.MaxInterval != 30*time.Second {
+		t.Errorf("Expected intervals 2s to 30s, got %s to %s", b.InitialInterval, b.MaxInterval)
+	}
+	if b.Multiplier != 2 || b.RandomizationFactor != 0.2 {
+		t.Errorf("Expected multiplier 2 and jitter 0.2, got %v and %v", b.Multiplier, b.RandomizationFactor)
+	}
+	if b.MaxElapsedTime != 0 {
+		t.Errorf("Expected polling to retry forever, got max elapsed time %s", b.MaxElapsedTime)
+	}
+}
+
+func TestNewPhaseBackOffsFromFlags(t *testing.T) {
+	defer func(initial, max, elapsed time.Duration) {
+		*pushRetryInitialWait, *pushRetryMaxWait, *pushRetryMaxElapsed = initial, max, elapsed
+	}(*pushRetryInitialWait, *pushRetryMaxWait, *pushRetryMaxElapsed)
+	defer func(initial, max time.Duration) {
+		*scrapeRetryInitialWait, *scrapeRetryMaxWait = initial, max
+	}(*scrapeRetryInitialWait, *scrapeRetryMaxWait)
+	*pushRetryInitialWait, *pushRetryMaxWait, *pushRetryMaxElapsed = 50*time.Millisecond, 2*time.Second, 10*time.Second
+	*scrapeRetryInitialWait, *scrapeRetryMaxWait = time.Second, 200*time.Millisecond
+
+	push := newPushBackOffFromFlags().(*backoff.ExponentialBackOff)
+	if push.InitialInterval != 50*time.Millisecond || push.MaxInterval != 2*time.Second || push.MaxElapsedTime != 10*time.Second {
+		t.Errorf("Expected push intervals 50ms to 2s for 10s, got %s to %s for %s", push.InitialInterval, push.MaxInterval, push.MaxElapsedTime)
+	}
+	scrape := newScrapeBackOffFromFlags().(*backoff.ExponentialBackOff)
+	if scrape.InitialInterval != 200*time.Millisecond || scrape.MaxInterval != 200*time.Millisecond {
+		t.Errorf("Expected the scrape initial wait to be capped at 200ms, got %s to %s", scrape.InitialInterval, scrape.MaxInterval)
+	}
+	if scrape.MaxElapsedTime != 0 {
+		t.Errorf("Expected scrapes to retry until their deadline, got max elapsed time %s", scrape.MaxElapsedTime)
+	}
+}
+
+// recordingBackOff records every wait handed out by the wrapped backoff.
+type recordingBackOff struct {
+	backoff.BackOff
+	waits []time.Duration
+}
+
+func (b *recordingBackOff) NextBackOff() time.Duration {
+	d := b.BackOff.NextBackOff()
+	b.waits = append(b.waits, d)
+	return d
+}
+
+func TestLoopResetsBackOff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	polls := 0
+	pushed := make(chan struct{}, 1)
+	client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if r.URL.Path != "/poll" {
+			if r.Body != nil {
+				io.Copy(ioutil.Discard, r.Body)
+				r.Body.Close()
+			}
+			if r.URL.Path == "/push" {
+				pushed <- struct{}{}
+			}
+			return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+		}
+		polls++
+		switch polls {
+		case 3:
+			body := "GET http://target/metrics HTTP/1.1\r\nHost: target\r\n\r\n"
+			return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(body))}, nil
+		case 5:
+			cancel()
+		}
+		return nil, errors.New("connection refused")
+	})}
+	c := Coordinator{logger: &TestLogger{}, proxyURLs: []*url.URL{parseURL("http://proxy/")}, scrapeClient: client}
+
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = time.Millisecond
+	b.Multiplier = 2
+	b.RandomizationFactor = 0
+	bo := &recordingBackOff{BackOff: b}
+	c.loop(ctx, bo, client)
+	<-pushed // Wait for the scrape to finish.
+
+	// Two failures, a successful poll, then another failure.
+	expected := []time.Duration{time.Millisecond, 2 * time.Millisecond, time.Millisecond}
+	if fmt.Sprint(bo.waits) != fmt.Sprint(expected) {
+		t.Errorf("Expected waits %v, got %v", expected, bo.waits)
+	}
+}
+
+func TestLoopFailover(t *testing.T) {
+	*proxyFailoverAfter = 2
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var hosts []string
+	client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		hosts = append(hosts, r.URL.Host)
+		if len(hosts) == 5 {
+			cancel()
+		}
+		return nil, errors.New("connection refused")
+	})}
+	c := Coordinator{logger: &TestLogger{}, proxyURLs: []*url.URL{parseURL("http://proxy-a/"), parseURL("http://proxy-b/")}}
+
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = time.Millisecond
+	c.loop(ctx, b, client)
+
+	// Every two failed polls move on to the next proxy, wrapping around.
+	expected := []string{"proxy-a", "proxy-a", "proxy-b", "proxy-b", "proxy-a"}
+	if fmt.Sprint(hosts) != fmt.Sprint(expected) {
+		t.Errorf("Expected polls to %v, got %v", expected, hosts)
+	}
+}
+
+func TestListenMetrics(t *testing.T) {
+	defer func(addr string, enabled bool) { *metricsAddr, *metricsServer = addr, enabled }(*metricsAddr, *metricsServer)
+
+	for _, tc := range []struct {
+		addr    string
+		enabled bool
+		listens bool
+	}{
+		{addr: "127.0.0.1:0", enabled: true, listens: true},
+		{addr: "127.0.0.1:0", enabled: false},
+		{addr: "", enabled: true},
+	} {
+		*metricsAddr, *metricsServer = tc.addr, tc.enabled
+		l, err := listenMetrics(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (l != nil) != tc.listens {
+			t.Errorf("Address %q, enabled %v: expected listening %v, got %v", tc.addr, tc.enabled, tc.listens, l != nil)
+		}
+		if l != nil {
+			l.Close()
+		}
+	}
+}
+
+func TestMetricsBasicAuth(t *testing.T) {
+	c := Coordinator{logger: &TestLogger{}}
+	h := c.metricsHandler("admin", "secret")
+
+	for _, tc := range []struct {
+		path, user, password string
+		status               int
+	}{
+		{path: "/metrics", status: http.StatusUnauthorized},
+		{path: "/metrics", user: "admin", password: "wrong", status: http.StatusUnauthorized},
+		{path: "/metrics", user: "other", password: "secret", status: http.StatusUnauthorized},
+		{path: "/metrics", user: "admin", password: "secret", status: http.StatusOK},
+		{path: "/healthz", status: http.StatusOK},
+	} {
+		req := httptest.NewRequest("GET", tc.path, nil)
+		if tc.user != "" {
+			req.SetBasicAuth(tc.user, tc.password)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != tc.status {
+			t.Errorf("%s as %q: expected status %d, got %d", tc.path, tc.user, tc.status, w.Code)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s as %q: expected a WWW-Authenticate header", tc.path, tc.user)
+		}
+	}
+}
+
+func TestHandleReady(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pushed := make(chan struct{}, 1)
+	client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if r.URL.Path != "/poll" {
+			if r.Body != nil {
+				io.Copy(ioutil.Discard, r.Body)
+				r.Body.Close()
+			}
+			if r.URL.Path == "/push" {
+				pushed <- struct{}{}
+			}
+			return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+		}
+		if ctx.Err() == nil {
+			cancel()
+			body := "GET http://target/metrics HTTP/1.1\r\nHost: target\r\n\r\n"
+			return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(body))}, nil
+		}
+		return nil, errors.New("connection refused")
+	})}
+	c := Coordinator{logger: &TestLogger{}, proxyURLs: []*url.URL{parseURL("http://proxy/")}, scrapeClient: client}
+
+	w := httptest.NewRecorder()
+	c.handleReady(w, httptest.NewRequest("GET", "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d before polling, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+
+	c.loop(ctx, backoff.NewExponentialBackOff(), client)
+	<-pushed // Wait for the scrape to finish.
+	w = httptest.NewRecorder()
+	c.handleReady(w, httptest.NewRequest("GET", "/readyz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status %d after polling, got %d", http.StatusOK, w.Code)
+	}
+}
+
+func TestDoScrapeTraceParent(t *testing.T) {
+	traceparents := make(chan string, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparents <- r.Header.Get("traceparent")
+	}))
+	defer target.Close()
+
+	proxy, pushed := prepareProxy(t)
+	defer proxy.Close()
+
+	c := Coordinator{logger: &TestLogger{}, proxyURLs: []*url.URL{parseURL(proxy.URL)}, scrapeClient: target.Client()}
+	*myFqdn = "127.0.0.1"
+
+	for _, incoming := range []string{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", ""} {
+		req, err := http.NewRequest("GET", target.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+		if incoming != "" {
+			req.Header.Set("traceparent", incoming)
+		}
+		c.doScrape(req, proxy.Client())
+		<-pushed
+		tp := <-traceparents
+		if incoming != "" && tp != incoming {
+			t.Errorf("Expected traceparent %q to be passed on, got %q", incoming, tp)
+		}
+		if !util.ValidTraceParent(tp) {
+			t.Errorf("Expected a valid traceparent, got %q", tp)
+		}
+	}
+}
+
+func TestNewTransportHTTP2(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+
+	for _, tc := range []struct {
+		http2 bool
+		proto string
+	}{
+		{http2: false, proto: "HTTP/1.1"},
+		{http2: true, proto: "HTTP/2.0"},
+	} {
+		transport := newTransport(&tls.Config{RootCAs: roots}, nil)
+		transport.ForceAttemptHTTP2 = tc.http2
+		resp, err := (&http.Client{Transport: transport}).Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.Proto != tc.proto {
+			t.Errorf("With http2 %v expected %s, got %s", tc.http2, tc.proto, resp.Proto)
+		}
+		transport.CloseIdleConnections()
+	}
+}
+
+func TestDoPushCompress(t *testing.T) {
+	*pushCompress = true
+	defer func() { *pushCompress = false }()
+
+	for _, tc := range []struct {
+		contentLength int64
+		compressed    bool
+	}{
+		{contentLength: -1, compressed: true},
+		{contentLength: 7, compressed: false},
+	} {
+		encoding := make(chan string, 1)
+		client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			body := io.Reader(r.Body)
+			if r.Header.Get("Content-Encoding") == "gzip" {
+				gz, err := gzip.NewReader(r.Body)
+				if err != nil {
+					return nil, err
+				}
+				body = gz
+			}
+			pushed, err := http.ReadResponse(bufio.NewReader(body), nil)
+			if err != nil {
+				return nil, err
+			}
+			io.Copy(ioutil.Discard, pushed.Body)
+			r.Body.Close()
+			encoding <- r.Header.Get("Content-Encoding")
+			return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+		})}
+		c := Coordinator{logger: &TestLogger{}, proxyURLs: []*url.URL{parseURL("http://proxy/")}}
+
+		req, err := http.NewRequest("GET", "http://target/metrics", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, ContentLength: tc.contentLength, Body: ioutil.NopCloser(strings.NewReader("metrics"))}
+		if err := c.doPush(req.Context(), resp, req, client); err != nil {
+			t.Fatalf("Content length %d: expected no error, got %v", tc.contentLength, err)
+		}
+		if got := <-encoding; (got == "gzip") != tc.compressed {
+			t.Errorf("Content length %d: expected compressed %v, got Content-Encoding %q", tc.contentLength, tc.compressed, got)
+		}
+	}
+}
+
+func TestLoopMaxConnectAttempts(t *testing.T) {
+	*maxConnectAttempts = 3
+	defer func() { *maxConnectAttempts = 0 }()
+	polls := 0
+	client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		polls++
+		return nil, errors.New("connection refused")
+	})}
+	c := Coordinator{logger: &TestLogger{}, proxyURLs: []*url.URL{parseURL("http://proxy/")}}
+
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = time.Millisecond
+	if err := c.loop(context.Background(), b, client); err == nil {
+		t.Error("Expected error, got none")
+	}
+	if polls != 3 {
+		t.Errorf("Expected 3 polls, got %d", polls)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/clients" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, "[]")
+	}))
+	defer proxy.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	*myFqdn = "client.example.com"
+
+	c := Coordinator{logger: &TestLogger{}, proxyURLs: []*url.URL{parseURL(proxy.URL + "/")}}
+	var out bytes.Buffer
+	if !c.check(proxy.Client(), &out) {
+		t.Errorf("Expected the check to pass, got:\n%s", out.String())
+	}
+	want := fmt.Sprintf("PASS fqdn client.example.com\nPASS proxy %s/\n", proxy.URL)
+	if out.String() != want {
+		t.Errorf("Expected report %q, got %q", want, out.String())
+	}
+
+	c.proxyURLs = append(c.proxyURLs, parseURL(down.URL+"/"))
+	out.Reset()
+	if c.check(proxy.Client(), &out) {
+		t.Errorf("Expected the check to fail with an unreachable proxy, got:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), fmt.Sprintf("FAIL proxy %s/: ", down.URL)) {
+		t.Errorf("Expected the unreachable proxy to fail, got:\n%s", out.String())
+	}
+}
+
+func TestUserAgentTransport(t *testing.T) {
+	var got string
+	client := &http.Client{Transport: &userAgentTransport{"pushprox-client/1.0 (client.example.com)", roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		got = r.Header.Get("User-Agent")
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("")), Request: r}, nil
+	})}}
+
+	req, err := http.NewRequest("GET", "http://target/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("User-Agent", "Prometheus/2.26.0")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if want := "pushprox-client/1.0 (client.example.com)"; got != want {
+		t.Errorf("Expected User-Agent %q, got %q", want, got)
+	}
+	if ua := req.Header.Get("User-Agent"); ua != "Prometheus/2.26.0" {
+		t.Errorf("Expected the original request to be left alone, got User-Agent %q", ua)
+	}
+}
+
+func TestIPv4Dialer(t *testing.T) {
+	var networks []string
+	dial := ipv4Dialer(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		networks = append(networks, network)
+		return nil, errors.New("not dialling")
+	})
+	for _, network := range []string{"tcp", "tcp6", "unix"} {
+		dial(context.Background(), network, "proxy:8080")
+	}
+	if want := []string{"tcp4", "tcp6", "unix"}; strings.Join(networks, ",") != strings.Join(want, ",") {
+		t.Errorf("Expected networks %v, got %v", want, networks)
+	}
+}
+
+func TestNewProxyDialer(t *testing.T) {
+	defer func(keepAlive time.Duration, localAddr string) {
+		*dialKeepAlive, *dialLocalAddr = keepAlive, localAddr
+	}(*dialKeepAlive, *dialLocalAddr)
+	*dialKeepAlive, *dialLocalAddr = 10*time.Second, "127.0.0.1"
+
+	d, err := newProxyDialer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.KeepAlive != 10*time.Second {
+		t.Errorf("Expected keep-alive 10s, got %s", d.KeepAlive)
+	}
+	if addr, ok := d.LocalAddr.(*net.TCPAddr); !ok || addr.String() != "127.0.0.1:0" {
+		t.Errorf("Expected local address 127.0.0.1:0, got %v", d.LocalAddr)
+	}
+
+	*dialLocalAddr = "not an address"
+	if _, err := newProxyDialer(); err == nil {
+		t.Error("Expected an error for an invalid local address")
+	}
+}
+
+func TestLoopMinPollInterval(t *testing.T) {
+	defer func(timeout, interval time.Duration) {
+		*proxyPollTimeout, *minPollInterval = timeout, interval
+	}(*proxyPollTimeout, *minPollInterval)
+	// Every poll succeeds without work after 1ms.
+	*proxyPollTimeout, *minPollInterval = time.Millisecond, 50*time.Millisecond
+
+	var (
+		mu    sync.Mutex
+		polls int
+	)
+	client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		io.Copy(ioutil.Discard, r.Body)
+		r.Body.Close()
+		mu.Lock()
+		polls++
+		mu.Unlock()
+		<-r.Context().Done()
+		return nil, r.Context().Err()
+	})}
+	c := Coordinator{logger: &TestLogger{}, proxyURLs: []*url.URL{parseURL("http://proxy/")}}
+	before := testutil.ToFloat64(pollIterationsCounter)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 175*time.Millisecond)
+	defer cancel()
+	if err := c.loop(ctx, backoff.NewConstantBackOff(time.Millisecond), client); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	// Polls start at 0, 50, 100 and 150ms.
+	if polls < 2 || polls > 5 {
+		t.Errorf("Expected about 4 polls 50ms apart, got %d", polls)
+	}
+	if got := testutil.ToFloat64(pollIterationsCounter) - before; got != float64(polls) {
+		t.Errorf("Expected %d poll iterations to be counted, got %v", polls, got)
+	}
+}
+
+func TestScrapeTimeoutOffset(t *testing.T) {
+	defer func(offset time.Duration) { *scrapeTimeoutOffset = offset }(*scrapeTimeoutOffset)
+
+	for _, tc := range []struct {
+		offset, timeout, want time.Duration
+	}{
+		{0, 10 * time.Second, 10 * time.Second},
+		{500 * time.Millisecond, 10 * time.Second, 9500 * time.Millisecond},
+		{time.Second, time.Second, time.Second},
+		{2 * time.Second, time.Second, time.Second},
+	} {
+		*scrapeTimeoutOffset = tc.offset
+		if got := scrapeTimeout(tc.timeout); got != tc.want {
+			t.Errorf("Offset %s of %s: expected %s, got %s", tc.offset, tc.timeout, tc.want, got)
+		}
+	}
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer target.Close()
+	proxy, pushed := prepareProxy(t)
+	defer proxy.Close()
+
+	c := Coordinator{logger: &TestLogger{}, proxyURLs: []*url.URL{parseURL(proxy.URL)}, scrapeClient: target.Client()}
+	*myFqdn = "127.0.0.1"
+	*scrapeTimeoutOffset = 1800 * time.Millisecond
+
+	req, err := http.NewRequest("GET", target.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "2.0")
+	start := time.Now()
+	c.doScrape(req, proxy.Client())
+	select {
+	case resp := <-pushed:
+		if resp.StatusCode != http.StatusGatewayTimeout {
+			t.Errorf("Expected pushed status %d, got %d", http.StatusGatewayTimeout, resp.StatusCode)
+		}
+	default:
+		t.Error("Expected a pushed response")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the scrape to give up after 200ms, took %s", elapsed)
+	}
+}
+
+func TestScrapeBudget(t *testing.T) {
+	before := testutil.ToFloat64(negativeScrapeBudgetCounter)
+	if got := scrapeBudget(time.Now().Add(10 * time.Second)); got <= 9 || got > 10 {
+		t.Errorf("Expected about 10s left, got %v", got)
+	}
+	if got := testutil.ToFloat64(negativeScrapeBudgetCounter) - before; got != 0 {
+		t.Errorf("Expected no negative budget to be counted, got %v", got)
+	}
+	if got := scrapeBudget(time.Now().Add(-time.Second)); got != 0 {
+		t.Errorf("Expected a passed deadline to leave 0s, got %v", got)
+	}
+	if got := testutil.ToFloat64(negativeScrapeBudgetCounter) - before; got != 1 {
+		t.Errorf("Expected 1 negative budget to be counted, got %v", got)
+	}
+}
+
+func TestHandleErrScrapeBudget(t *testing.T) {
+	proxy, pushed := prepareProxy(t)
+	defer proxy.Close()
+	c := Coordinator{logger: &TestLogger{}, proxyURLs: []*url.URL{parseURL(proxy.URL)}}
+
+	// Rejected before the scrape timeout applies, no budget to report.
+	before := testutil.ToFloat64(negativeScrapeBudgetCounter)
+	req, err := http.NewRequest("GET", "http://client:9100/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.handleErr(c.logger, req, proxy.Client(), errors.New("too many concurrent scrapes"))
+	select {
+	case resp := <-pushed:
+		if v, ok := resp.Header["X-Prometheus-Scrape-Timeout"]; ok {
+			t.Errorf("Expected no X-Prometheus-Scrape-Timeout, got %q", v)
+		}
+	default:
+		t.Error("Expected a pushed response")
+	}
+	if got := testutil.ToFloat64(negativeScrapeBudgetCounter) - before; got != 0 {
+		t.Errorf("Expected no negative budget to be counted, got %v", got)
+	}
+
+	// Timed out, pushed after the scrape deadline.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	<-ctx.Done()
+	c.handleErr(c.logger, req.WithContext(ctx), proxy.Client(), ctx.Err())
+	select {
+	case resp := <-pushed:
+		if v := resp.Header.Get("X-Prometheus-Scrape-Timeout"); v != "0.000000" {
+			t.Errorf("Expected X-Prometheus-Scrape-Timeout 0.000000, got %q", v)
+		}
+	default:
+		t.Error("Expected a pushed response")
+	}
+	if got := testutil.ToFloat64(negativeScrapeBudgetCounter) - before; got != 1 {
+		t.Errorf("Expected 1 negative budget to be counted, got %v", got)
+	}
+}
+
+func TestDoScrapeKeepsQuery(t *testing.T) {
+	var got url.Values
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.Query()
+		fmt.Fprint(w, "up 1\n")
+	}))
+	defer target.Close()
+	proxy, pushed := prepareProxy(t)
+	defer proxy.Close()
+
+	c := Coordinator{logger: &TestLogger{}, proxyURLs: []*url.URL{parseURL(proxy.URL)}, scrapeClient: target.Client()}
+	*myFqdn = "127.0.0.1"
+
+	// _scheme is removed from the query, match[] must survive that.
+	query := url.Values{"match[]": []string{`{job="a"}`, "up"}, "_scheme": []string{"https"}}
+	req, err := http.NewRequest("GET", strings.Replace(target.URL, "https:", "http:", 1)+"/federate?"+query.Encode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+	c.doScrape(req, proxy.Client())
+	select {
+	case resp := <-pushed:
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected pushed status %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+	default:
+		t.Error("Expected a pushed response")
+	}
+	want := url.Values{"match[]": []string{`{job="a"}`, "up"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected the target to get query %v, got %v", want, got)
+	}
+}
+
+func TestDoScrapeHeaders(t *testing.T) {
+	var got http.Header
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+		fmt.Fprint(w, "up 1\n")
+	}))
+	defer target.Close()
+	proxy, pushed := prepareProxy(t)
+	defer proxy.Close()
+
+	c := Coordinator{logger: &TestLogger{}, proxyURLs: []*url.URL{parseURL(proxy.URL)}, scrapeClient: target.Client()}
+	*myFqdn = "127.0.0.1"
+
+	req, err := http.NewRequest("GET", target.URL+"/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+	req.Header.Set("Id", "scrape-1")
+	req.Header.Set("X-Scope-OrgID", "tenant")
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "1")
+	req.Header.Set("Proxy-Authorization", "Basic dXNlcjpwYXNz")
+	c.doScrape(req, proxy.Client())
+	select {
+	case resp := <-pushed:
+		if id := resp.Header.Get("Id"); id != "scrape-1" {
+			t.Errorf("Expected the pushed response to have id scrape-1, got %q", id)
+		}
+	default:
+		t.Error("Expected a pushed response")
+	}
+	if got.Get("X-Scope-OrgID") != "tenant" {
+		t.Errorf("Expected X-Scope-OrgID to reach the target, got %v", got)
+	}
+	for _, name := range []string{"Id", "X-Hop", "Proxy-Authorization"} {
+		if v := got.Get(name); v != "" {
+			t.Errorf("Expected %s not to reach the target, got %q", name, v)
+		}
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := Coordinator{logger: &TestLogger{}}
+
+	// Polls keep being started, so the watchdog stays quiet.
+	exited := make(chan struct{}, 1)
+	go c.watchdog(ctx, 100*time.Millisecond, func() { exited <- struct{}{} })
+	for i := 0; i < 30; i++ {
+		atomic.StoreInt64(&c.lastPollStart, time.Now().UnixNano())
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case <-exited:
+		t.Fatal("Expected no exit while polls are started")
+	default:
+	}
+
+	// Polls stop, so the watchdog exits.
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		t.Error("Expected an exit once polls stopped")
+	}
+}
+
+func TestDoScrapeMaxTimeout(t *testing.T) {
+	defer func(max time.Duration) { *maxScrapeTimeout = max }(*maxScrapeTimeout)
+	*maxScrapeTimeout = time.Minute
+
+	var (
+		header   string
+		deadline time.Duration
+	)
+	scrapeClient := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		header = r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds")
+		d, _ := r.Context().Deadline()
+		deadline = time.Until(d)
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader("up 1\n")), Request: r}, nil
+	})}
+	proxy, pushed := prepareProxy(t)
+	defer proxy.Close()
+	c := Coordinator{logger: &TestLogger{}, proxyURLs: []*url.URL{parseURL(proxy.URL)}, scrapeClient: scrapeClient}
+	*myFqdn = "127.0.0.1"
+
+	req, err := http.NewRequest("GET", "http://127.0.0.1:9100/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "86400")
+	c.doScrape(req, proxy.Client())
+	select {
+	case <-pushed:
+	default:
+		t.Error("Expected a pushed response")
+	}
+	if header != "60" {
+		t.Errorf("Expected the target to get timeout header 60, got %q", header)
+	}
+	if deadline > time.Minute {
+		t.Errorf("Expected the scrape deadline to be clamped to 1m, got %s", deadline)
+	}
 }
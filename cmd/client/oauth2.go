@@ -0,0 +1,188 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// Tokens are refreshed this long before they expire.
+	oauth2ExpiryDelta = time.Minute
+	// Token requests are abandoned after this long.
+	oauth2FetchTimeout = 30 * time.Second
+	// A failed token request isn't retried for this long, so a token
+	// endpoint that is down isn't asked at the scrape rate.
+	oauth2RetryDelay = 5 * time.Second
+)
+
+var oauth2FetchErrorCounter = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "pushprox_client_oauth2_token_fetch_errors_total",
+		Help: "Number of failed OAuth 2.0 token requests",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(oauth2FetchErrorCounter)
+}
+
+// newTokenClient returns the client for token requests. It has its own
+// transport and timeout, so a stalled token endpoint can't tie up
+// connections to the proxy.
+func newTokenClient(tlsConfig *tls.Config) *http.Client {
+	return &http.Client{
+		Transport: &userAgentTransport{*userAgent, newTransport(tlsConfig, nil)},
+		Timeout:   oauth2FetchTimeout,
+	}
+}
+
+// clientCredentialsToken mints scrape tokens with the OAuth 2.0 client
+// credentials grant and caches them until shortly before they expire.
+type clientCredentialsToken struct {
+	tokenURL   string
+	clientID   string
+	secretFile string
+	scopes     []string
+	client     *http.Client
+	logger     log.Logger
+
+	mu         sync.Mutex
+	token      string
+	expiry     time.Time     // Zero if the token doesn't expire.
+	refreshing chan struct{} // Closed when the fetch in progress is done.
+	err        error         // Error of the last fetch.
+	errTime    time.Time     // When the last fetch failed.
+}
+
+// Get returns a cached token, fetching a new one when it is close to expiry.
+// Only one fetch runs at a time. Callers that arrive during it get the old
+// token if it hasn't expired yet, otherwise they wait for the fetch. For
+// oauth2RetryDelay after a failed fetch its error is returned instead of
+// fetching again.
+func (t *clientCredentialsToken) Get() (string, error) {
+	t.mu.Lock()
+	if t.token != "" && (t.expiry.IsZero() || time.Until(t.expiry) > oauth2ExpiryDelta) {
+		defer t.mu.Unlock()
+		return t.token, nil
+	}
+	if done := t.refreshing; done != nil {
+		if t.valid() {
+			defer t.mu.Unlock()
+			return t.token, nil
+		}
+		t.mu.Unlock()
+		<-done
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.err != nil && !t.valid() {
+			return "", t.err
+		}
+		return t.token, nil
+	}
+	if t.err != nil && time.Since(t.errTime) < oauth2RetryDelay {
+		defer t.mu.Unlock()
+		if t.valid() {
+			return t.token, nil
+		}
+		return "", t.err
+	}
+	done := make(chan struct{})
+	t.refreshing = done
+	t.mu.Unlock()
+
+	token, expiry, err := t.fetch()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.refreshing = nil
+	t.err = err
+	close(done)
+	if err != nil {
+		t.errTime = time.Now()
+		oauth2FetchErrorCounter.Inc()
+		if t.valid() {
+			// The early refresh failed but the old token is still good.
+			level.Warn(t.logger).Log("msg", "Failed to refresh OAuth 2.0 token", "err", err)
+			return t.token, nil
+		}
+		return "", err
+	}
+	t.token, t.expiry = token, expiry
+	return token, nil
+}
+
+// valid reports whether the cached token hasn't expired yet. t.mu must be
+// held.
+func (t *clientCredentialsToken) valid() bool {
+	return t.token != "" && (t.expiry.IsZero() || time.Now().Before(t.expiry))
+}
+
+func (t *clientCredentialsToken) fetch() (string, time.Time, error) {
+	secret, err := ioutil.ReadFile(t.secretFile)
+	if err != nil {
+		return "", time.Time{}, errors.Wrap(err, "cannot read oauth2 client secret")
+	}
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(t.scopes) > 0 {
+		form.Set("scope", strings.Join(t.scopes, " "))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), oauth2FetchTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, "POST", t.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.SetBasicAuth(url.QueryEscape(t.clientID), url.QueryEscape(strings.TrimSpace(string(secret))))
+
+	resp, err := t.client.Do(request)
+	if err != nil {
+		return "", time.Time{}, errors.Wrap(err, "cannot fetch oauth2 token")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return "", time.Time{}, fmt.Errorf("cannot fetch oauth2 token: token endpoint returned %s", resp.Status)
+	}
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", time.Time{}, errors.Wrap(err, "cannot decode oauth2 token response")
+	}
+	if body.AccessToken == "" {
+		return "", time.Time{}, errors.New("oauth2 token response has no access_token")
+	}
+	var expiry time.Time
+	if body.ExpiresIn > 0 {
+		expiry = time.Now().Add(time.Duration(body.ExpiresIn) * time.Second)
+	}
+	level.Info(t.logger).Log("msg", "Fetched OAuth 2.0 token", "expiry", expiry)
+	return body.AccessToken, expiry, nil
+}
@@ -0,0 +1,169 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestClientCredentialsToken(t *testing.T) {
+	fetches := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		id, secret, _ := r.BasicAuth()
+		if id != "client" || secret != "secret" {
+			t.Errorf("Expected client:secret, got %s:%s", id, secret)
+		}
+		if r.FormValue("grant_type") != "client_credentials" || r.FormValue("scope") != "a b" {
+			t.Errorf("Unexpected token request form %v", r.Form)
+		}
+		fmt.Fprintf(w, `{"access_token":"token-%d","token_type":"Bearer","expires_in":3600}`, fetches)
+	}))
+	defer ts.Close()
+
+	secretFile, err := ioutil.TempFile("", "pushprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(secretFile.Name())
+	secretFile.WriteString("secret\n")
+	secretFile.Close()
+
+	token := &clientCredentialsToken{
+		tokenURL:   ts.URL,
+		clientID:   "client",
+		secretFile: secretFile.Name(),
+		scopes:     []string{"a", "b"},
+		client:     ts.Client(),
+		logger:     &TestLogger{},
+	}
+
+	// Fetched once, then cached
+	for i := 0; i < 2; i++ {
+		got, err := token.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != "token-1" {
+			t.Errorf("Expected token-1, got %q", got)
+		}
+	}
+
+	// Refreshed close to expiry
+	token.expiry = time.Now().Add(oauth2ExpiryDelta / 2)
+	got, err := token.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "token-2" {
+		t.Errorf("Expected token-2, got %q", got)
+	}
+}
+
+func TestClientCredentialsTokenRefreshUnlocked(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		fmt.Fprint(w, `{"access_token":"new","token_type":"Bearer","expires_in":3600}`)
+	}))
+	defer ts.Close()
+
+	secretFile, err := ioutil.TempFile("", "pushprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(secretFile.Name())
+	secretFile.Close()
+
+	token := &clientCredentialsToken{
+		tokenURL:   ts.URL,
+		clientID:   "client",
+		secretFile: secretFile.Name(),
+		client:     ts.Client(),
+		logger:     &TestLogger{},
+		token:      "old",
+		expiry:     time.Now().Add(oauth2ExpiryDelta / 2),
+	}
+
+	refreshed := make(chan string)
+	go func() {
+		got, err := token.Get()
+		if err != nil {
+			t.Error(err)
+		}
+		refreshed <- got
+	}()
+	<-started
+
+	// The refresh is stalled, the old token is still handed out.
+	got, err := token.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "old" {
+		t.Errorf("Expected old, got %q", got)
+	}
+
+	close(release)
+	if got := <-refreshed; got != "new" {
+		t.Errorf("Expected new, got %q", got)
+	}
+}
+
+func TestClientCredentialsTokenRetryDelay(t *testing.T) {
+	fetches := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	secretFile, err := ioutil.TempFile("", "pushprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(secretFile.Name())
+	secretFile.Close()
+
+	token := &clientCredentialsToken{
+		tokenURL:   ts.URL,
+		clientID:   "client",
+		secretFile: secretFile.Name(),
+		client:     ts.Client(),
+		logger:     &TestLogger{},
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := token.Get(); err == nil {
+			t.Error("Expected an error while the token endpoint is down")
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("Expected 1 token request right after a failure, got %d", fetches)
+	}
+
+	// Retried once the delay has passed.
+	token.errTime = time.Now().Add(-oauth2RetryDelay)
+	token.Get()
+	if fetches != 2 {
+		t.Errorf("Expected a second token request after the delay, got %d", fetches)
+	}
+}
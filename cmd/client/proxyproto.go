@@ -0,0 +1,94 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// proxyProtocolSignature starts every PROXY protocol v2 header.
+var proxyProtocolSignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocolDialer makes dial send a PROXY protocol header of version,
+// "v1" or "v2", on each new connection, so load balancers in front of the
+// proxy can pass on the client's address.
+func proxyProtocolDialer(version string, dial func(context.Context, string, string) (net.Conn, error)) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		header, err := proxyProtocolHeader(version, conn.LocalAddr(), conn.RemoteAddr())
+		if err == nil {
+			_, err = conn.Write(header)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+// proxyProtocolHeader returns the header describing a connection from src
+// to dst. Connections other than TCP are sent as UNKNOWN in v1 and LOCAL in
+// v2, which tell the receiver to use the connection's own addresses.
+func proxyProtocolHeader(version string, src, dst net.Addr) ([]byte, error) {
+	srcTCP, srcOK := src.(*net.TCPAddr)
+	dstTCP, dstOK := dst.(*net.TCPAddr)
+	tcp := srcOK && dstOK
+	ipv4 := tcp && srcTCP.IP.To4() != nil && dstTCP.IP.To4() != nil
+
+	switch version {
+	case "v1":
+		if !tcp {
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+		family := "TCP6"
+		if ipv4 {
+			family = "TCP4"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, srcTCP.IP, dstTCP.IP, srcTCP.Port, dstTCP.Port)), nil
+	case "v2":
+		var b bytes.Buffer
+		b.Write(proxyProtocolSignature)
+		if !tcp {
+			// Version 2, LOCAL command, unspecified family, no addresses.
+			b.Write([]byte{0x20, 0x00, 0x00, 0x00})
+			return b.Bytes(), nil
+		}
+		// Version 2, PROXY command.
+		b.WriteByte(0x21)
+		srcIP, dstIP := srcTCP.IP.To16(), dstTCP.IP.To16()
+		if ipv4 {
+			// TCP over IPv4.
+			b.WriteByte(0x11)
+			srcIP, dstIP = srcTCP.IP.To4(), dstTCP.IP.To4()
+		} else {
+			// TCP over IPv6.
+			b.WriteByte(0x21)
+		}
+		binary.Write(&b, binary.BigEndian, uint16(2*len(srcIP)+4))
+		b.Write(srcIP)
+		b.Write(dstIP)
+		binary.Write(&b, binary.BigEndian, uint16(srcTCP.Port))
+		binary.Write(&b, binary.BigEndian, uint16(dstTCP.Port))
+		return b.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unknown PROXY protocol version %q", version)
+}
@@ -0,0 +1,179 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+func TestProxyProtocolHeader(t *testing.T) {
+	v4src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}
+	v4dst := &net.TCPAddr{IP: net.ParseIP("198.51.100.2"), Port: 8080}
+	v6src := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}
+	v6dst := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 8080}
+	unix := &net.UnixAddr{Name: "/run/pushprox.sock", Net: "unix"}
+	sig := string(proxyProtocolSignature)
+
+	for _, tc := range []struct {
+		version  string
+		src, dst net.Addr
+		want     string
+	}{
+		{"v1", v4src, v4dst, "PROXY TCP4 192.0.2.1 198.51.100.2 56324 8080\r\n"},
+		{"v1", v6src, v6dst, "PROXY TCP6 2001:db8::1 2001:db8::2 56324 8080\r\n"},
+		{"v1", unix, unix, "PROXY UNKNOWN\r\n"},
+		{"v2", v4src, v4dst, sig + "\x21\x11\x00\x0c" +
+			"\xc0\x00\x02\x01" + "\xc6\x33\x64\x02" + "\xdc\x04" + "\x1f\x90"},
+		{"v2", v6src, v6dst, sig + "\x21\x21\x00\x24" +
+			"\x20\x01\x0d\xb8" + "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+			"\x20\x01\x0d\xb8" + "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02" +
+			"\xdc\x04" + "\x1f\x90"},
+		{"v2", unix, unix, sig + "\x20\x00\x00\x00"},
+	} {
+		got, err := proxyProtocolHeader(tc.version, tc.src, tc.dst)
+		if err != nil {
+			t.Errorf("%s %v: %v", tc.version, tc.src, err)
+			continue
+		}
+		if string(got) != tc.want {
+			t.Errorf("%s %v: expected %q, got %q", tc.version, tc.src, tc.want, got)
+		}
+	}
+
+	if _, err := proxyProtocolHeader("v3", v4src, v4dst); err == nil {
+		t.Error("Expected an error for an unknown version")
+	}
+}
+
+func TestProxyProtocolDialer(t *testing.T) {
+	for _, version := range []string{"v1", "v2"} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+
+		dial := proxyProtocolDialer(version, (&net.Dialer{}).DialContext)
+		conn, err := dial(context.Background(), "tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if _, err := fmt.Fprint(conn, "GET"); err != nil {
+			t.Fatal(err)
+		}
+
+		server, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+		want, err := proxyProtocolHeader(version, conn.LocalAddr(), conn.RemoteAddr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(want)+len("GET"))
+		if _, err := io.ReadFull(server, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, append(want, "GET"...)) {
+			t.Errorf("%s: expected the header before the request, got %q", version, got)
+		}
+	}
+}
+
+// proxyHeaderListener counts the connections that start with a PROXY
+// protocol header.
+type proxyHeaderListener struct {
+	net.Listener
+	headers int32
+}
+
+func (l *proxyHeaderListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	if b, err := r.Peek(5); err == nil && (string(b) == "PROXY" || bytes.HasPrefix(proxyProtocolSignature, b)) {
+		atomic.AddInt32(&l.headers, 1)
+	}
+	return &bufferedConn{conn, r}, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+func TestProxyProtocolOnlyToProxy(t *testing.T) {
+	defer func(version string) { *proxyProtocol = version }(*proxyProtocol)
+	*proxyProtocol = "v1"
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"access_token":"token","token_type":"Bearer","expires_in":3600}`)
+	}))
+	l := &proxyHeaderListener{Listener: ts.Listener}
+	ts.Listener = l
+	ts.Start()
+	defer ts.Close()
+
+	secretFile, err := ioutil.TempFile("", "pushprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(secretFile.Name())
+	secretFile.Close()
+
+	token := &clientCredentialsToken{
+		tokenURL:   ts.URL,
+		clientID:   "client",
+		secretFile: secretFile.Name(),
+		client:     newTokenClient(nil),
+		logger:     &TestLogger{},
+	}
+	if _, err := token.Get(); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&l.headers); n != 0 {
+		t.Errorf("Expected the token endpoint not to get a PROXY header, got %d", n)
+	}
+
+	transport, err := newProxyTransport(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.CloseIdleConnections()
+	// The test server doesn't understand the header, so only the
+	// connection matters here, not the response.
+	if resp, err := (&http.Client{Transport: transport}).Get(ts.URL); err == nil {
+		resp.Body.Close()
+	}
+	if n := atomic.LoadInt32(&l.headers); n != 1 {
+		t.Errorf("Expected the proxy to get a PROXY header, got %d", n)
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// targetRouter sends scrapes to local addresses by the port or path they
+// were made to, so one client can serve several exporters. A nil router
+// sends every scrape where it was made to.
+type targetRouter struct {
+	ports map[string]string
+	// Path prefixes, longest first so the most specific one wins.
+	prefixes []prefixRoute
+}
+
+type prefixRoute struct {
+	prefix, addr string
+}
+
+// parseTargetRouter parses --scrape.target, a map from a port or a path
+// prefix starting with / to the host:port to scrape instead.
+func parseTargetRouter(targets map[string]string) (*targetRouter, error) {
+	if len(targets) == 0 {
+		return nil, nil
+	}
+	r := &targetRouter{ports: map[string]string{}}
+	for key, addr := range targets {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("invalid address %q for %q: %v", addr, key, err)
+		}
+		if strings.HasPrefix(key, "/") {
+			r.prefixes = append(r.prefixes, prefixRoute{key, addr})
+			continue
+		}
+		port, err := parsePort(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target %q, must be a port or a path starting with /", key)
+		}
+		r.ports[strconv.Itoa(port)] = addr
+	}
+	sort.Slice(r.prefixes, func(i, j int) bool {
+		if len(r.prefixes[i].prefix) != len(r.prefixes[j].prefix) {
+			return len(r.prefixes[i].prefix) > len(r.prefixes[j].prefix)
+		}
+		return r.prefixes[i].prefix < r.prefixes[j].prefix
+	})
+	return r, nil
+}
+
+// route returns the address to scrape u at, matching its port before its
+// path, and false if nothing matches.
+func (r *targetRouter) route(u *url.URL) (string, bool) {
+	if r == nil {
+		return "", false
+	}
+	if addr, ok := r.ports[u.Port()]; ok {
+		return addr, true
+	}
+	for _, p := range r.prefixes {
+		if strings.HasPrefix(u.Path, p.prefix) {
+			return p.addr, true
+		}
+	}
+	return "", false
+}
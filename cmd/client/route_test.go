@@ -0,0 +1,67 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestTargetRouter(t *testing.T) {
+	r, err := parseTargetRouter(map[string]string{
+		"9100":          "127.0.0.1:9101",
+		"/probe":        "127.0.0.1:9115",
+		"/probe/snmp":   "127.0.0.1:9116",
+		"/federate/app": "[::1]:9090",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		url  string
+		want string
+	}{
+		{"http://client:9100/metrics", "127.0.0.1:9101"},
+		{"http://client:9100/probe", "127.0.0.1:9101"},
+		{"http://client:8080/probe?target=a", "127.0.0.1:9115"},
+		{"http://client:8080/probe/snmp", "127.0.0.1:9116"},
+		{"http://client/federate/app", "[::1]:9090"},
+		{"http://client:8080/metrics", ""},
+	} {
+		u, err := url.Parse(tc.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok := r.route(u)
+		if ok != (tc.want != "") || got != tc.want {
+			t.Errorf("%s: expected route %q, got %q", tc.url, tc.want, got)
+		}
+	}
+
+	var none *targetRouter
+	if _, ok := none.route(&url.URL{Host: "client:9100"}); ok {
+		t.Error("Expected a nil router to route nothing")
+	}
+
+	for _, targets := range []map[string]string{
+		{"abc": "127.0.0.1:9100"},
+		{"70000": "127.0.0.1:9100"},
+		{"9100": "127.0.0.1"},
+		{"/probe": ""},
+	} {
+		if _, err := parseTargetRouter(targets); err == nil {
+			t.Errorf("%v: expected an error", targets)
+		}
+	}
+}
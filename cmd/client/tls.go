@@ -0,0 +1,282 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rancher/pushprox/util"
+)
+
+var (
+	tlsUseSystemPool = kingpin.Flag("tls.use-system-pool", "Add the CA certificates given by the cacert flags to the system pool rather than replacing it").Default("false").Bool()
+	tlsMinVersion    = kingpin.Flag("tls.min-version", "Minimum TLS version for all connections").Enum("1.2", "1.3")
+	tlsCipherSuites  = kingpin.Flag("tls.cipher-suites", "Comma separated TLS 1.2 cipher suites to allow for all connections, as named by Go").String()
+)
+
+var (
+	metricsTLSCert     = kingpin.Flag("metrics.tls.cert", "<cert> Certificate to serve metrics over https with").String()
+	metricsTLSKey      = kingpin.Flag("metrics.tls.key", "<key> Private key of --metrics.tls.cert").String()
+	metricsTLSClientCA = kingpin.Flag("metrics.tls.client-ca", "<file> CA certificate to require and verify client certificates of metrics scrapers against").String()
+)
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// cipherSuiteIDs maps a comma separated list of cipher suite names to
+// their IDs, only secure suites are accepted.
+func cipherSuiteIDs(names string) ([]uint16, error) {
+	known := map[string]uint16{}
+	valid := make([]string, 0, len(tls.CipherSuites()))
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+		valid = append(valid, suite.Name)
+	}
+	var ids []uint16
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q, valid suites are %s", name, strings.Join(valid, ", "))
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// How often client certificate files are checked for changes.
+const certReloadInterval = 10 * time.Second
+
+var (
+	certReloadCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pushprox_client_certificate_reloads_total",
+			Help: "Number of times a client certificate was reloaded",
+		},
+	)
+	certReloadErrorCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pushprox_client_certificate_reload_errors_total",
+			Help: "Number of failed client certificate reloads",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(certReloadCounter, certReloadErrorCounter)
+}
+
+// tlsFlags are the flags that describe one TLS client configuration.
+type tlsFlags struct {
+	caCert             *string
+	cert               *string
+	key                *string
+	insecureSkipVerify *bool
+	serverName         *string
+}
+
+// newTLSFlags registers a group of TLS flags named with prefix, used for
+// connections to target.
+func newTLSFlags(prefix, target string) tlsFlags {
+	return tlsFlags{
+		caCert:             kingpin.Flag(prefix+"cacert", "<file> CA certificate to verify "+target+" against").String(),
+		cert:               kingpin.Flag(prefix+"cert", "<cert> Client certificate file for "+target).String(),
+		key:                kingpin.Flag(prefix+"key", "<key> Private key file for "+target).String(),
+		insecureSkipVerify: kingpin.Flag(prefix+"insecure-skip-verify", "Disable SSL security checks for "+target).Default("false").Bool(),
+		serverName:         kingpin.Flag(prefix+"servername", "Server name to send as SNI and verify the certificate of "+target+" against, instead of the host connected to. With insecure-skip-verify it is only sent as SNI").String(),
+	}
+}
+
+// isSet reports whether any flag of the group was given. The server name
+// isn't counted, as it is applied on top of whichever configuration is used.
+func (f tlsFlags) isSet() bool {
+	return *f.caCert != "" || *f.cert != "" || *f.key != "" || *f.insecureSkipVerify
+}
+
+// config builds the TLS configuration described by the flags. A client
+// certificate is reloaded whenever its files change.
+func (f tlsFlags) config(logger log.Logger) (*tls.Config, error) {
+	// The client certificate is loaded below, so that it can be reloaded.
+	tlsConfig, err := util.NewTLSConfig("", "", *f.caCert, *f.insecureSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.MinVersion = tlsVersions[*tlsMinVersion]
+	if *tlsCipherSuites != "" {
+		ids, err := cipherSuiteIDs(*tlsCipherSuites)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.CipherSuites = ids
+	}
+	if *f.cert != "" {
+		pair, err := newKeyPair(*f.cert, *f.key, logger)
+		if err != nil {
+			return nil, err
+		}
+		go pair.watch()
+		tlsConfig.GetClientCertificate = pair.GetClientCertificate
+	}
+	if *f.caCert != "" && *tlsUseSystemPool {
+		systemPool, err := x509.SystemCertPool()
+		if err != nil {
+			level.Warn(logger).Log("msg", "System certificate pool is unavailable, using only the cacert file", "err", err)
+		} else if tlsConfig.RootCAs, err = util.AppendCertsFromFile(systemPool, *f.caCert); err != nil {
+			return nil, err
+		}
+	}
+	return tlsConfig, nil
+}
+
+// withServerName returns a copy of tlsConfig that sends and verifies
+// serverName, or tlsConfig itself if serverName is empty.
+func withServerName(tlsConfig *tls.Config, serverName string) *tls.Config {
+	if serverName == "" {
+		return tlsConfig
+	}
+	if tlsConfig == nil {
+		return &tls.Config{ServerName: serverName}
+	}
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.ServerName = serverName
+	return tlsConfig
+}
+
+// metricsTLSConfig builds the TLS configuration of the metrics server, it
+// returns nil if metrics are served over plain http.
+func metricsTLSConfig() (*tls.Config, error) {
+	if *metricsTLSCert == "" && *metricsTLSKey == "" {
+		if *metricsTLSClientCA != "" {
+			return nil, errors.New("--metrics.tls.client-ca requires --metrics.tls.cert and --metrics.tls.key")
+		}
+		return nil, nil
+	}
+	tlsConfig, err := util.NewTLSConfig(*metricsTLSCert, *metricsTLSKey, "", false)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.MinVersion = tlsVersions[*tlsMinVersion]
+	if *tlsCipherSuites != "" {
+		if tlsConfig.CipherSuites, err = cipherSuiteIDs(*tlsCipherSuites); err != nil {
+			return nil, err
+		}
+	}
+	if *metricsTLSClientCA != "" {
+		if tlsConfig.ClientCAs, err = util.AppendCertsFromFile(x509.NewCertPool(), *metricsTLSClientCA); err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// keyPair holds a client certificate and reloads it when the certificate or
+// key file changes. A pair that fails to load is ignored and the previous
+// one kept.
+type keyPair struct {
+	certFile string
+	keyFile  string
+	logger   log.Logger
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+// newKeyPair loads the pair, failing if it is invalid.
+func newKeyPair(certFile, keyFile string, logger log.Logger) (*keyPair, error) {
+	k := &keyPair{certFile: certFile, keyFile: keyFile, logger: logger}
+	if err := k.load(); err != nil {
+		return nil, errors.Wrap(err, "certificate or key is invalid")
+	}
+	return k, nil
+}
+
+// GetClientCertificate returns the current certificate, for use as
+// tls.Config.GetClientCertificate.
+func (k *keyPair) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.cert, nil
+}
+
+// load reads the pair if either file changed since the last load.
+func (k *keyPair) load() error {
+	certInfo, err := os.Stat(k.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(k.keyFile)
+	if err != nil {
+		return err
+	}
+	k.mu.Lock()
+	unchanged := k.cert != nil && certInfo.ModTime().Equal(k.certMod) && keyInfo.ModTime().Equal(k.keyMod)
+	k.mu.Unlock()
+	if unchanged {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(k.certFile, k.keyFile)
+	if err != nil {
+		return err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.cert = &cert
+	k.certMod, k.keyMod = certInfo.ModTime(), keyInfo.ModTime()
+	return nil
+}
+
+// reload loads the pair again if it changed, keeping the current one on
+// failure.
+func (k *keyPair) reload() {
+	k.mu.Lock()
+	previous := k.cert
+	k.mu.Unlock()
+	if err := k.load(); err != nil {
+		level.Error(k.logger).Log("msg", "Failed to reload client certificate, keeping the current one", "cert", k.certFile, "err", err)
+		certReloadErrorCounter.Inc()
+		return
+	}
+	k.mu.Lock()
+	changed := k.cert != previous
+	k.mu.Unlock()
+	if changed {
+		level.Info(k.logger).Log("msg", "Reloaded client certificate", "cert", k.certFile)
+		certReloadCounter.Inc()
+	}
+}
+
+// watch reloads the pair periodically, it never returns.
+func (k *keyPair) watch() {
+	for range time.Tick(certReloadInterval) {
+		k.reload()
+	}
+}
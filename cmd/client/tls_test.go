@@ -0,0 +1,247 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeKeyPair writes a self-signed certificate for commonName and its key,
+// stamped with modTime.
+func writeKeyPair(t *testing.T, certFile, keyFile, commonName string, modTime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.Chtimes(f, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func commonName(t *testing.T, k *keyPair) string {
+	cert, err := k.GetClientCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed.Subject.CommonName
+}
+
+func TestKeyPairReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pushprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	now := time.Now()
+
+	writeKeyPair(t, certFile, keyFile, "first", now)
+	k, err := newKeyPair(certFile, keyFile, &TestLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cn := commonName(t, k); cn != "first" {
+		t.Errorf("Expected first, got %s", cn)
+	}
+
+	// With a new pair written
+	writeKeyPair(t, certFile, keyFile, "second", now.Add(time.Minute))
+	k.reload()
+	if cn := commonName(t, k); cn != "second" {
+		t.Errorf("Expected second, got %s", cn)
+	}
+
+	// With a malformed key the current pair is kept
+	if err := ioutil.WriteFile(keyFile, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := now.Add(2 * time.Minute)
+	if err := os.Chtimes(keyFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+	k.reload()
+	if cn := commonName(t, k); cn != "second" {
+		t.Errorf("Expected second, got %s", cn)
+	}
+}
+
+func TestCipherSuiteIDs(t *testing.T) {
+	for _, tc := range []struct {
+		names string
+		ids   []uint16
+		err   bool
+	}{
+		{names: "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", ids: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}},
+		{names: "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384", ids: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}},
+		{names: "TLS_NOT_A_SUITE", err: true},
+		{names: "TLS_RSA_WITH_RC4_128_SHA", err: true}, // Insecure
+	} {
+		ids, err := cipherSuiteIDs(tc.names)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%s: expected error, got none", tc.names)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: expected no error, got %v", tc.names, err)
+			continue
+		}
+		if len(ids) != len(tc.ids) {
+			t.Errorf("%s: expected %v, got %v", tc.names, tc.ids, ids)
+			continue
+		}
+		for i := range ids {
+			if ids[i] != tc.ids[i] {
+				t.Errorf("%s: expected %v, got %v", tc.names, tc.ids, ids)
+			}
+		}
+	}
+}
+
+func TestMetricsTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pushprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	serverCert, serverKey := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem")
+	clientCert, clientKey := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem")
+	writeKeyPair(t, serverCert, serverKey, "server", time.Now())
+	writeKeyPair(t, clientCert, clientKey, "client", time.Now())
+	defer func(addr string, enabled bool) { *metricsAddr, *metricsServer = addr, enabled }(*metricsAddr, *metricsServer)
+	defer func() { *metricsTLSCert, *metricsTLSKey, *metricsTLSClientCA = "", "", "" }()
+	*metricsAddr, *metricsServer = "127.0.0.1:0", true
+
+	*metricsTLSClientCA = clientCert
+	if _, err := metricsTLSConfig(); err == nil {
+		t.Error("Expected error for a client CA without a certificate, got none")
+	}
+	*metricsTLSCert, *metricsTLSKey = serverCert, serverKey
+	tlsConfig, err := metricsTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := listenMetrics(tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	pair, err := tls.LoadX509KeyPair(clientCert, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, certs := range [][]tls.Certificate{nil, {pair}} {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true, Certificates: certs}}}
+		resp, err := client.Get("https://" + l.Addr().String() + "/")
+		if len(certs) == 0 {
+			if err == nil {
+				resp.Body.Close()
+				t.Error("Expected error without a client certificate, got none")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Expected no error with a client certificate, got %v", err)
+		}
+		resp.Body.Close()
+	}
+}
+
+func TestWithServerName(t *testing.T) {
+	sni := make(chan string, 1)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sni <- r.TLS.ServerName
+	}))
+	ts.TLS = &tls.Config{}
+	ts.StartTLS()
+	defer ts.Close()
+	// The test server's certificate is for example.com and 127.0.0.1.
+	base := ts.Client().Transport.(*http.Transport).TLSClientConfig
+
+	if withServerName(base, "") != base {
+		t.Error("Expected the configuration to be kept without a server name")
+	}
+	for _, tc := range []struct {
+		serverName string
+		insecure   bool
+		ok         bool
+	}{
+		{serverName: "example.com", ok: true},
+		{serverName: "wrong.example", ok: false},
+		{serverName: "wrong.example", insecure: true, ok: true},
+	} {
+		config := base.Clone()
+		config.InsecureSkipVerify = tc.insecure
+		config = withServerName(config, tc.serverName)
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+		resp, err := client.Get(ts.URL)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s, insecure %v: expected success %v, got error %v", tc.serverName, tc.insecure, tc.ok, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if got := <-sni; got != tc.serverName {
+			t.Errorf("%s: expected SNI %q, got %q", tc.serverName, tc.serverName, got)
+		}
+	}
+	if base.ServerName != "" {
+		t.Errorf("Expected the original configuration to be left alone, got server name %q", base.ServerName)
+	}
+}
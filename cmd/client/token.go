@@ -0,0 +1,200 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// How often the token file is checked for changes.
+	tokenReloadInterval = 10 * time.Second
+	// How long before a token expires to warn that it wasn't rotated.
+	tokenExpiryWarning = 5 * time.Minute
+)
+
+var (
+	tokenReloadCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pushprox_client_token_reloads_total",
+			Help: "Number of times the bearer token was reloaded",
+		},
+	)
+	tokenReloadErrorCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pushprox_client_token_reload_errors_total",
+			Help: "Number of failed bearer token reloads",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(tokenReloadCounter, tokenReloadErrorCounter)
+}
+
+// bearerToken keeps the token from --token-path in memory and reloads it
+// when the file changes, so scrapes don't read the file each time.
+type bearerToken struct {
+	path     string
+	audience string
+	logger   log.Logger
+
+	mu    sync.Mutex
+	token string
+	err   error
+	// Expiry of a JWT, zero for other tokens and JWTs without one.
+	expiry time.Time
+	// Whether the coming expiry of the token was logged.
+	warned  bool
+	modTime time.Time
+	size    int64
+}
+
+// newBearerToken loads the token at path, failing if it can't be read or
+// isn't valid for audience.
+func newBearerToken(path, audience string, logger log.Logger) (*bearerToken, error) {
+	t := &bearerToken{path: path, audience: audience, logger: logger}
+	t.reload()
+	if _, err := t.Get(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Get returns the current token, or why it is unavailable.
+func (t *bearerToken) Get() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err != nil || t.expiry.IsZero() {
+		return t.token, t.err
+	}
+	left := time.Until(t.expiry)
+	if left <= 0 {
+		return "", errors.Errorf("token from token-path expired at %s", t.expiry)
+	}
+	if left < tokenExpiryWarning && !t.warned {
+		level.Warn(t.logger).Log("msg", "Token expires soon, check that it is being rotated", "path", t.path, "expiry", t.expiry)
+		t.warned = true
+	}
+	return t.token, nil
+}
+
+// reload reads the token file again if it changed since the last read.
+func (t *bearerToken) reload() {
+	info, err := os.Stat(t.path)
+	if err == nil {
+		t.mu.Lock()
+		unchanged := t.err == nil && info.ModTime().Equal(t.modTime) && info.Size() == t.size
+		t.mu.Unlock()
+		if unchanged {
+			return
+		}
+	}
+	var (
+		token  []byte
+		expiry time.Time
+	)
+	if err == nil {
+		token, err = ioutil.ReadFile(t.path)
+	}
+	if err != nil {
+		err = errors.Wrap(err, "cannot read token from token-path")
+	} else {
+		expiry, err = checkToken(string(token), t.audience)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err != nil {
+		if t.err == nil {
+			level.Error(t.logger).Log("msg", "Failed to reload token", "path", t.path, "err", err)
+		}
+		tokenReloadErrorCounter.Inc()
+		t.err = err
+		t.token = ""
+		return
+	}
+	if t.err == nil && string(token) == t.token {
+		t.modTime, t.size = info.ModTime(), info.Size()
+		return
+	}
+	level.Info(t.logger).Log("msg", "Loaded token", "path", t.path)
+	tokenReloadCounter.Inc()
+	t.token, t.err = string(token), nil
+	t.expiry, t.warned = expiry, false
+	t.modTime, t.size = info.ModTime(), info.Size()
+}
+
+// checkToken rejects empty tokens, and JWTs without audience in their aud
+// claim if it is set. It returns the exp claim of a JWT, or zero for other
+// tokens.
+func checkToken(token, audience string) (time.Time, error) {
+	if strings.TrimSpace(token) == "" {
+		return time.Time{}, errors.New("token from token-path is empty")
+	}
+	var claims struct {
+		Exp float64         `json:"exp"`
+		Aud json.RawMessage `json:"aud"`
+	}
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	isJWT := len(parts) == 3
+	if isJWT {
+		payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+		isJWT = err == nil && json.Unmarshal(payload, &claims) == nil
+	}
+	if !isJWT {
+		if audience != "" {
+			return time.Time{}, errors.New("token from token-path isn't a JWT, so its audience can't be checked")
+		}
+		return time.Time{}, nil
+	}
+	if audience != "" {
+		// aud is either a single audience or a list of them.
+		var auds []string
+		if json.Unmarshal(claims.Aud, &auds) != nil {
+			var aud string
+			json.Unmarshal(claims.Aud, &aud)
+			auds = []string{aud}
+		}
+		found := false
+		for _, aud := range auds {
+			found = found || aud == audience
+		}
+		if !found {
+			return time.Time{}, errors.Errorf("token from token-path isn't for audience %q", audience)
+		}
+	}
+	if claims.Exp == 0 {
+		return time.Time{}, nil
+	}
+	return time.Unix(int64(claims.Exp), 0), nil
+}
+
+// watch reloads the token periodically, it never returns.
+func (t *bearerToken) watch() {
+	for range time.Tick(tokenReloadInterval) {
+		t.reload()
+	}
+}
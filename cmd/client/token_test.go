@@ -0,0 +1,141 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBearerTokenReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pushprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "token")
+
+	// With the file missing
+	if _, err := newBearerToken(path, "", &TestLogger{}); err == nil {
+		t.Error("Expected error, got none")
+	}
+
+	if err := ioutil.WriteFile(path, []byte("first"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	token, err := newBearerToken(path, "", &TestLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := token.Get(); got != "first" {
+		t.Errorf("Expected first, got %q", got)
+	}
+
+	// With the file rewritten
+	if err := ioutil.WriteFile(path, []byte("second"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	token.reload()
+	if got, _ := token.Get(); got != "second" {
+		t.Errorf("Expected second, got %q", got)
+	}
+
+	// With the file removed
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	token.reload()
+	if _, err := token.Get(); err == nil {
+		t.Error("Expected error, got none")
+	}
+}
+
+// jwt returns an unsigned JWT with the given claims.
+func jwt(claims string) string {
+	enc := base64.RawURLEncoding.EncodeToString
+	return enc([]byte(`{"alg":"none"}`)) + "." + enc([]byte(claims)) + ".sig"
+}
+
+func TestCheckToken(t *testing.T) {
+	for _, tc := range []struct {
+		token    string
+		audience string
+		expiry   int64
+		valid    bool
+	}{
+		{token: "opaque", valid: true},
+		{token: " \n", valid: false},
+		{token: "opaque", audience: "pushprox", valid: false},
+		{token: jwt(`{"exp":1700000000}`), expiry: 1700000000, valid: true},
+		{token: jwt(`{"aud":"pushprox"}`), audience: "pushprox", valid: true},
+		{token: jwt(`{"aud":["api","pushprox"],"exp":1700000000}`), audience: "pushprox", expiry: 1700000000, valid: true},
+		{token: jwt(`{"aud":"api"}`), audience: "pushprox", valid: false},
+		{token: jwt(`{}`), audience: "pushprox", valid: false},
+	} {
+		expiry, err := checkToken(tc.token, tc.audience)
+		if (err == nil) != tc.valid {
+			t.Errorf("%q for %q: expected valid %v, got error %v", tc.token, tc.audience, tc.valid, err)
+			continue
+		}
+		if tc.expiry != 0 && expiry.Unix() != tc.expiry || tc.expiry == 0 && !expiry.IsZero() {
+			t.Errorf("%q: expected expiry %d, got %s", tc.token, tc.expiry, expiry)
+		}
+	}
+}
+
+func TestBearerTokenExpiry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pushprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "token")
+
+	soon := jwt(fmt.Sprintf(`{"exp":%d}`, time.Now().Add(time.Minute).Unix()))
+	if err := ioutil.WriteFile(path, []byte(soon), 0600); err != nil {
+		t.Fatal(err)
+	}
+	token, err := newBearerToken(path, "", &TestLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := token.Get(); err != nil || got != soon {
+		t.Errorf("Expected a token expiring soon to be used, got %q, %v", got, err)
+	}
+	if !token.warned {
+		t.Error("Expected a warning about the coming expiry")
+	}
+
+	expired := jwt(fmt.Sprintf(`{"exp":%d}`, time.Now().Add(-time.Minute).Unix()))
+	if err := ioutil.WriteFile(path, []byte(expired), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	token.reload()
+	if _, err := token.Get(); err == nil {
+		t.Error("Expected an error for an expired token")
+	}
+}
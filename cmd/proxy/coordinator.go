@@ -15,8 +15,10 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"sort"
 	"sync"
 	"time"
 
@@ -31,7 +33,9 @@ import (
 )
 
 var (
-	registrationTimeout = kingpin.Flag("registration.timeout", "After how long a registration expires.").Default("5m").Duration()
+	registrationTimeout  = kingpin.Flag("registration.timeout", "After how long a registration expires.").Default("5m").Duration()
+	scrapeRateLimit      = kingpin.Flag("scrape.rate-limit", "Maximum scrapes per second of each client, further scrapes get a 429. 0 means no limit.").Default("0").Float64()
+	scrapeRateLimitBurst = kingpin.Flag("scrape.rate-limit-burst", "Number of scrapes of a client allowed at once above the rate limit.").Default("5").Int()
 )
 
 // Coordinator metrics.
@@ -43,6 +47,27 @@ var (
 			Help:      "Number of known pushprox clients.",
 		},
 	)
+	scrapeRateLimited = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "scrape_rate_limited_total",
+			Help:      "Number of scrapes rejected by the per client rate limit.",
+		}, []string{"fqdn"},
+	)
+	clientExpirations = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "client_expirations_total",
+			Help:      "Number of clients removed after not polling within the registration timeout.",
+		},
+	)
+)
+
+var (
+	// ErrUnknownClient is returned when scraping a client that isn't registered.
+	ErrUnknownClient = errors.New("client is not registered or its registration expired")
+	// ErrRateLimited is returned when scraping a client too often.
+	ErrRateLimited = errors.New("client scrape rate limit exceeded")
 )
 
 // Coordinator for scrape requests and responses
@@ -55,6 +80,12 @@ type Coordinator struct {
 	responses map[string]chan *http.Response
 	// Clients we know about and when they last contacted us.
 	known map[string]time.Time
+	// Labels clients registered with, only for clients that have any.
+	labels map[string]map[string]string
+	// Scrapes in flight per client.
+	inflight map[string]int
+	// Scrape rate limits per client.
+	limiters map[string]*tokenBucket
 
 	logger log.Logger
 }
@@ -65,6 +96,9 @@ func NewCoordinator(logger log.Logger) (*Coordinator, error) {
 		waiting:   map[string]chan *http.Request{},
 		responses: map[string]chan *http.Response{},
 		known:     map[string]time.Time{},
+		labels:    map[string]map[string]string{},
+		inflight:  map[string]int{},
+		limiters:  map[string]*tokenBucket{},
 		logger:    logger,
 	}
 
@@ -113,12 +147,30 @@ func (c *Coordinator) DoScrape(ctx context.Context, r *http.Request) (*http.Resp
 	if err != nil {
 		return nil, err
 	}
-	level.Info(c.logger).Log("msg", "DoScrape", "scrape_id", id, "url", r.URL.String())
+	// Trace the scrape through the proxy and client logs.
+	if !util.ValidTraceParent(r.Header.Get("traceparent")) {
+		r.Header.Set("traceparent", util.NewTraceParent())
+	}
+	level.Info(c.logger).Log("msg", "DoScrape", "scrape_id", id, "traceparent", r.Header.Get("traceparent"), "url", r.URL.String())
+	if !c.allowScrape(r.URL.Hostname()) {
+		return nil, ErrRateLimited
+	}
 	r.Header.Add("Id", id)
+	c.trackInflight(r.URL.Hostname(), 1)
+	defer c.trackInflight(r.URL.Hostname(), -1)
+	ch := c.getRequestChannel(r.URL.Hostname())
 	select {
-	case <-ctx.Done():
-		return nil, fmt.Errorf("Timeout reached for %q: %s", r.URL.String(), ctx.Err())
-	case c.getRequestChannel(r.URL.Hostname()) <- r:
+	case ch <- r:
+	default:
+		// No poll is waiting, only wait for one from a live client.
+		if !c.isKnown(r.URL.Hostname()) {
+			return nil, ErrUnknownClient
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("Timeout reached for %q: %s", r.URL.String(), ctx.Err())
+		case ch <- r:
+		}
 	}
 
 	respCh := c.getResponseChannel(id)
@@ -132,11 +184,12 @@ func (c *Coordinator) DoScrape(ctx context.Context, r *http.Request) (*http.Resp
 	}
 }
 
-// WaitForScrapeInstruction registers a client waiting for a scrape result
-func (c *Coordinator) WaitForScrapeInstruction(fqdn string) (*http.Request, error) {
+// WaitForScrapeInstruction registers a client and its labels, waiting for
+// a scrape result
+func (c *Coordinator) WaitForScrapeInstruction(fqdn string, labels map[string]string) (*http.Request, error) {
 	level.Info(c.logger).Log("msg", "WaitForScrapeInstruction", "fqdn", fqdn)
 
-	c.addKnownClient(fqdn)
+	c.addKnownClient(fqdn, labels)
 	// TODO: What if the client times out?
 	ch := c.getRequestChannel(fqdn)
 
@@ -181,14 +234,80 @@ func (c *Coordinator) ScrapeResult(r *http.Response) error {
 	}
 }
 
-func (c *Coordinator) addKnownClient(fqdn string) {
+func (c *Coordinator) addKnownClient(fqdn string, labels map[string]string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	c.known[fqdn] = time.Now()
+	if len(labels) > 0 {
+		c.labels[fqdn] = labels
+	} else {
+		delete(c.labels, fqdn)
+	}
 	knownClients.Set(float64(len(c.known)))
 }
 
+// Deregister forgets a client so it is no longer scraped, waking up any
+// poll it left waiting.
+func (c *Coordinator) Deregister(fqdn string) {
+	c.mu.Lock()
+	ch, ok := c.waiting[fqdn]
+	delete(c.waiting, fqdn)
+	c.forget(fqdn)
+	knownClients.Set(float64(len(c.known)))
+	c.mu.Unlock()
+
+	if ok {
+		select {
+		case ch <- nil:
+		default:
+		}
+	}
+}
+
+// forget drops what is kept about a registered client, along with its
+// metrics. c.mu must be held.
+func (c *Coordinator) forget(fqdn string) {
+	delete(c.known, fqdn)
+	delete(c.labels, fqdn)
+	delete(c.limiters, fqdn)
+	scrapeRateLimited.DeleteLabelValues(fqdn)
+}
+
+// allowScrape applies the per client scrape rate limit.
+func (c *Coordinator) allowScrape(fqdn string) bool {
+	if *scrapeRateLimit <= 0 {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.known[fqdn]; !ok {
+		// Don't track clients that never registered.
+		return true
+	}
+	now := time.Now()
+	b, ok := c.limiters[fqdn]
+	if !ok {
+		b = newTokenBucket(*scrapeRateLimit, *scrapeRateLimitBurst, now)
+		c.limiters[fqdn] = b
+	}
+	if b.allow(now) {
+		return true
+	}
+	scrapeRateLimited.WithLabelValues(fqdn).Inc()
+	return false
+}
+
+// isKnown reports whether the client has polled within the registration timeout.
+func (c *Coordinator) isKnown(fqdn string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, ok := c.known[fqdn]
+	return ok && time.Now().Add(-*registrationTimeout).Before(t)
+}
+
 // KnownClients returns a list of alive clients
 func (c *Coordinator) KnownClients() []string {
 	c.mu.Lock()
@@ -204,6 +323,48 @@ func (c *Coordinator) KnownClients() []string {
 	return known
 }
 
+// Labels returns the labels a client registered with, nil if it has none.
+func (c *Coordinator) Labels(fqdn string) map[string]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.labels[fqdn]
+}
+
+func (c *Coordinator) trackInflight(fqdn string, delta int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.inflight[fqdn] += delta
+	if c.inflight[fqdn] == 0 {
+		delete(c.inflight, fqdn)
+	}
+}
+
+// ClientStatus describes a registered client.
+type ClientStatus struct {
+	FQDN            string            `json:"fqdn"`
+	LastPoll        time.Time         `json:"last_poll"`
+	InflightScrapes int               `json:"inflight_scrapes"`
+	Labels          map[string]string `json:"labels,omitempty"`
+}
+
+// ClientStatuses returns the status of alive clients
+func (c *Coordinator) ClientStatuses() []ClientStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	limit := time.Now().Add(-*registrationTimeout)
+	statuses := make([]ClientStatus, 0, len(c.known))
+	for k, t := range c.known {
+		if limit.Before(t) {
+			statuses = append(statuses, ClientStatus{FQDN: k, LastPoll: t, InflightScrapes: c.inflight[k], Labels: c.labels[k]})
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].FQDN < statuses[j].FQDN })
+	return statuses
+}
+
 // Garbagee collect old clients.
 func (c *Coordinator) gc() {
 	for range time.Tick(1 * time.Minute) {
@@ -214,10 +375,11 @@ func (c *Coordinator) gc() {
 			deleted := 0
 			for k, ts := range c.known {
 				if ts.Before(limit) {
-					delete(c.known, k)
+					c.forget(k)
 					deleted++
 				}
 			}
+			clientExpirations.Add(float64(deleted))
 			level.Info(c.logger).Log("msg", "GC of clients completed", "deleted", deleted, "remaining", len(c.known))
 			knownClients.Set(float64(len(c.known)))
 		}()
@@ -0,0 +1,183 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func init() {
+	// Flag defaults aren't applied without parsing.
+	*maxScrapeTimeout = 5 * time.Minute
+	*defaultScrapeTimeout = 15 * time.Second
+}
+
+func TestDoScrapeUnknownClient(t *testing.T) {
+	*registrationTimeout = time.Minute
+	c, err := NewCoordinator(log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequest("GET", "http://unknown:9100/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.DoScrape(ctx, req.WithContext(ctx)); !errors.Is(err, ErrUnknownClient) {
+		t.Errorf("Expected ErrUnknownClient, got %v", err)
+	}
+}
+
+func TestDoScrapeKnownClient(t *testing.T) {
+	*registrationTimeout = time.Minute
+	c, err := NewCoordinator(log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A client that polled recently is waited for, even if it isn't
+	// polling right now.
+	c.addKnownClient("client", nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequest("GET", "http://client:9100/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(ctx)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		scrape, err := c.WaitForScrapeInstruction("client", nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Id": {scrape.Header.Get("Id")}}}
+		if err := c.ScrapeResult(resp); err != nil {
+			t.Error(err)
+		}
+	}()
+	resp, err := c.DoScrape(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestDoScrapeRateLimit(t *testing.T) {
+	*registrationTimeout = time.Minute
+	*scrapeRateLimit = 0.001
+	*scrapeRateLimitBurst = 1
+	defer func() { *scrapeRateLimit = 0 }()
+	c, err := NewCoordinator(log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.addKnownClient("client", nil)
+
+	if !c.allowScrape("client") {
+		t.Error("Expected the first scrape to be allowed")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequest("GET", "http://client:9100/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.DoScrape(ctx, req.WithContext(ctx)); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("Expected ErrRateLimited, got %v", err)
+	}
+	if !c.allowScrape("other") {
+		t.Error("Expected other clients not to be limited")
+	}
+
+	series := testutil.CollectAndCount(scrapeRateLimited)
+	c.Deregister("client")
+	if got := testutil.CollectAndCount(scrapeRateLimited); got != series-1 {
+		t.Errorf("Expected the deregistered client's series to be deleted, got %d series, was %d", got, series)
+	}
+}
+
+func TestDeregisterWhileScraping(t *testing.T) {
+	*registrationTimeout = time.Minute
+	c, err := NewCoordinator(log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	newScrape := func() *http.Request {
+		req, err := http.NewRequest("GET", "http://client:9100/metrics", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return req.WithContext(ctx)
+	}
+
+	c.addKnownClient("client", nil)
+	polled := make(chan *http.Request)
+	go func() {
+		scrape, err := c.WaitForScrapeInstruction("client", nil)
+		if err != nil {
+			t.Error(err)
+		}
+		polled <- scrape
+	}()
+	scraped := make(chan error)
+	go func() {
+		_, err := c.DoScrape(ctx, newScrape())
+		scraped <- err
+	}()
+
+	// Deregister with one scrape handed to the client and another poll waiting.
+	scrape := <-polled
+	waiting := make(chan error)
+	go func() {
+		_, err := c.WaitForScrapeInstruction("client", nil)
+		waiting <- err
+	}()
+	// Deregister until the poll has started waiting and is ended.
+	for done := false; !done; {
+		c.Deregister("client")
+		select {
+		case err := <-waiting:
+			if err == nil {
+				t.Error("Expected the waiting poll to be ended with an error")
+			}
+			done = true
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Id": {scrape.Header.Get("Id")}}}
+	if err := c.ScrapeResult(resp); err != nil {
+		t.Error(err)
+	}
+	if err := <-scraped; err != nil {
+		t.Errorf("Expected the scrape in flight to complete, got %v", err)
+	}
+	if _, err := c.DoScrape(ctx, newScrape()); !errors.Is(err, ErrUnknownClient) {
+		t.Errorf("Expected ErrUnknownClient after deregistering, got %v", err)
+	}
+}
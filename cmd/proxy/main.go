@@ -16,13 +16,18 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"regexp"
+	"sort"
 	"strings"
 
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
@@ -45,6 +50,8 @@ var (
 	listenAddress        = kingpin.Flag("web.listen-address", "Address to listen on for proxy and client requests.").Default(":8080").String()
 	maxScrapeTimeout     = kingpin.Flag("scrape.max-timeout", "Any scrape with a timeout higher than this will have to be clamped to this.").Default("5m").Duration()
 	defaultScrapeTimeout = kingpin.Flag("scrape.default-timeout", "If a scrape lacks a timeout, use this value.").Default("15s").Duration()
+	clientsTokenFile     = kingpin.Flag("clients.token-file", "If set, /clients/status requires this bearer token.").String()
+	scrapeTokenFile      = kingpin.Flag("scrape.auth-token-file", "If set, proxied scrapes require this bearer token in the Authorization or Proxy-Authorization header.").String()
 )
 
 var (
@@ -90,6 +97,24 @@ type httpHandler struct {
 	coordinator *Coordinator
 	mux         http.Handler
 	proxy       http.Handler
+	// Bearer token required for /clients/status, empty if not required.
+	clientsToken string
+	// Bearer token required for proxied scrapes, empty if not required.
+	scrapeToken string
+}
+
+// hasBearerToken reports whether the header holds the bearer token.
+func hasBearerToken(header, token string) bool {
+	return subtle.ConstantTimeCompare([]byte(header), []byte("Bearer "+token)) == 1
+}
+
+// readToken reads a bearer token from a file.
+func readToken(path string) (string, error) {
+	token, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(token)), nil
 }
 
 func newHTTPHandler(logger log.Logger, coordinator *Coordinator, mux *http.ServeMux) *httpHandler {
@@ -97,10 +122,13 @@ func newHTTPHandler(logger log.Logger, coordinator *Coordinator, mux *http.Serve
 
 	// api handlers
 	handlers := map[string]http.HandlerFunc{
-		"/push":    h.handlePush,
-		"/poll":    h.handlePoll,
-		"/clients": h.handleListClients,
-		"/metrics": promhttp.Handler().ServeHTTP,
+		"/push":           h.handlePush,
+		"/poll":           h.handlePoll,
+		"/deregister":     h.handleDeregister,
+		"/clients":        h.handleListClients,
+		"/clients/status": h.handleClientStatus,
+		"/sd":             h.handleServiceDiscovery,
+		"/metrics":        promhttp.Handler().ServeHTTP,
 	}
 	for path, handlerFunc := range handlers {
 		counter := httpAPICounter.MustCurryWith(prometheus.Labels{"path": path})
@@ -125,15 +153,32 @@ func newHTTPHandler(logger log.Logger, coordinator *Coordinator, mux *http.Serve
 
 // handlePush handles scrape responses from client.
 func (h *httpHandler) handlePush(w http.ResponseWriter, r *http.Request) {
+	body := r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			level.Error(h.logger).Log("msg", "Error reading pushed response:", "err", err)
+			http.Error(w, fmt.Sprintf("Error pushing: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
 	buf := &bytes.Buffer{}
-	io.Copy(buf, r.Body)
+	if _, err := io.Copy(buf, body); err != nil {
+		// Don't hand a truncated scrape to Prometheus, the client will
+		// push an error in its place.
+		level.Error(h.logger).Log("msg", "Error reading pushed response:", "err", err)
+		http.Error(w, fmt.Sprintf("Error pushing: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
 	scrapeResult, err := http.ReadResponse(bufio.NewReader(buf), nil)
 	if err != nil {
 		level.Error(h.logger).Log("msg", "Error reading pushed response:", "err", err)
 		http.Error(w, fmt.Sprintf("Error pushing: %s", err.Error()), 500)
 		return
 	}
-	level.Info(h.logger).Log("msg", "Got /push", "scrape_id", scrapeResult.Header.Get("Id"))
+	level.Info(h.logger).Log("msg", "Got /push", "scrape_id", scrapeResult.Header.Get("Id"), "traceparent", r.Header.Get("traceparent"))
 	err = h.coordinator.ScrapeResult(scrapeResult)
 	if err != nil {
 		level.Error(h.logger).Log("msg", "Error pushing:", "err", err, "scrape_id", scrapeResult.Header.Get("Id"))
@@ -144,7 +189,12 @@ func (h *httpHandler) handlePush(w http.ResponseWriter, r *http.Request) {
 // handlePoll handles clients registering and asking for scrapes.
 func (h *httpHandler) handlePoll(w http.ResponseWriter, r *http.Request) {
 	fqdn, _ := ioutil.ReadAll(r.Body)
-	request, err := h.coordinator.WaitForScrapeInstruction(strings.TrimSpace(string(fqdn)))
+	labels, err := util.DecodeLabels(r.Header.Get(util.LabelsHeader))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid %s header: %s", util.LabelsHeader, err.Error()), http.StatusBadRequest)
+		return
+	}
+	request, err := h.coordinator.WaitForScrapeInstruction(strings.TrimSpace(string(fqdn)), labels)
 	if err != nil {
 		level.Info(h.logger).Log("msg", "Error WaitForScrapeInstruction:", "err", err)
 		http.Error(w, fmt.Sprintf("Error WaitForScrapeInstruction: %s", err.Error()), 408)
@@ -154,25 +204,99 @@ func (h *httpHandler) handlePoll(w http.ResponseWriter, r *http.Request) {
 	level.Info(h.logger).Log("msg", "Responded to /poll", "url", request.URL.String(), "scrape_id", request.Header.Get("Id"))
 }
 
+// handleDeregister handles clients shutting down.
+func (h *httpHandler) handleDeregister(w http.ResponseWriter, r *http.Request) {
+	fqdn, _ := ioutil.ReadAll(r.Body)
+	h.coordinator.Deregister(strings.TrimSpace(string(fqdn)))
+	level.Info(h.logger).Log("msg", "Deregistered client", "fqdn", strings.TrimSpace(string(fqdn)))
+}
+
 // handleListClients handles requests to list available clients as a JSON array.
 func (h *httpHandler) handleListClients(w http.ResponseWriter, r *http.Request) {
 	known := h.coordinator.KnownClients()
 	targets := make([]*targetGroup, 0, len(known))
 	for _, k := range known {
-		targets = append(targets, &targetGroup{Targets: []string{k}})
+		targets = append(targets, &targetGroup{Targets: []string{k}, Labels: h.coordinator.Labels(k)})
 	}
 	json.NewEncoder(w).Encode(targets)
 	level.Info(h.logger).Log("msg", "Responded to /clients", "client_count", len(known))
 }
 
+// handleServiceDiscovery handles Prometheus http_sd_config requests, listing
+// clients whose FQDN matches the optional fqdn regular expression parameter.
+func (h *httpHandler) handleServiceDiscovery(w http.ResponseWriter, r *http.Request) {
+	filter := regexp.MustCompile("")
+	if f := r.URL.Query().Get("fqdn"); f != "" {
+		var err error
+		filter, err = regexp.Compile("^(?:" + f + ")$")
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid fqdn filter: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+	}
+	known := h.coordinator.KnownClients()
+	sort.Strings(known)
+	targets := make([]*targetGroup, 0, len(known))
+	for _, k := range known {
+		if !filter.MatchString(k) {
+			continue
+		}
+		labels := map[string]string{"__meta_pushprox_fqdn": k}
+		for name, value := range h.coordinator.Labels(k) {
+			labels["__meta_pushprox_label_"+name] = value
+		}
+		targets = append(targets, &targetGroup{
+			Targets: []string{k},
+			Labels:  labels,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(targets)
+	level.Info(h.logger).Log("msg", "Responded to /sd", "client_count", len(targets))
+}
+
+// handleClientStatus handles requests for the last poll and in flight scrapes of each client.
+func (h *httpHandler) handleClientStatus(w http.ResponseWriter, r *http.Request) {
+	if h.clientsToken != "" && !hasBearerToken(r.Header.Get("Authorization"), h.clientsToken) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	statuses := h.coordinator.ClientStatuses()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+	level.Info(h.logger).Log("msg", "Responded to /clients/status", "client_count", len(statuses))
+}
+
 // handleProxy handles proxied scrapes from Prometheus.
 func (h *httpHandler) handleProxy(w http.ResponseWriter, r *http.Request) {
+	if h.scrapeToken != "" {
+		// The token is meant for the proxy, don't pass it on to the target.
+		switch {
+		case hasBearerToken(r.Header.Get("Proxy-Authorization"), h.scrapeToken):
+			r.Header.Del("Proxy-Authorization")
+		case hasBearerToken(r.Header.Get("Authorization"), h.scrapeToken):
+			r.Header.Del("Authorization")
+		default:
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
 	ctx, cancel := context.WithTimeout(r.Context(), util.GetScrapeTimeout(maxScrapeTimeout, defaultScrapeTimeout, r.Header))
 	defer cancel()
 	request := r.WithContext(ctx)
 	request.RequestURI = ""
 
 	resp, err := h.coordinator.DoScrape(ctx, request)
+	if errors.Is(err, ErrUnknownClient) {
+		level.Info(h.logger).Log("msg", "Scrape of unknown client", "url", request.URL.String())
+		http.Error(w, fmt.Sprintf("Error scraping %q: %s", request.URL.String(), err.Error()), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrRateLimited) {
+		level.Warn(h.logger).Log("msg", "Scrape rate limited", "url", request.URL.String())
+		http.Error(w, fmt.Sprintf("Error scraping %q: %s", request.URL.String(), err.Error()), http.StatusTooManyRequests)
+		return
+	}
 	if err != nil {
 		level.Error(h.logger).Log("msg", "Error scraping:", "err", err, "url", request.URL.String())
 		http.Error(w, fmt.Sprintf("Error scraping %q: %s", request.URL.String(), err.Error()), 500)
@@ -205,6 +329,20 @@ func main() {
 
 	mux := http.NewServeMux()
 	handler := newHTTPHandler(logger, coordinator, mux)
+	if *clientsTokenFile != "" {
+		handler.clientsToken, err = readToken(*clientsTokenFile)
+		if err != nil {
+			level.Error(logger).Log("msg", "Reading clients token failed", "err", err)
+			os.Exit(1)
+		}
+	}
+	if *scrapeTokenFile != "" {
+		handler.scrapeToken, err = readToken(*scrapeTokenFile)
+		if err != nil {
+			level.Error(logger).Log("msg", "Reading scrape token failed", "err", err)
+			os.Exit(1)
+		}
+	}
 
 	level.Info(logger).Log("msg", "Listening", "address", *listenAddress)
 	if err := http.ListenAndServe(*listenAddress, handler); err != nil {
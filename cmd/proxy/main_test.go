@@ -0,0 +1,328 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/rancher/pushprox/util"
+)
+
+func TestHandleServiceDiscovery(t *testing.T) {
+	*registrationTimeout = time.Minute
+	c, err := NewCoordinator(log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fqdn := range []string{"web-1", "web-2", "db-1"} {
+		c.addKnownClient(fqdn, nil)
+	}
+	h := newHTTPHandler(log.NewNopLogger(), c, http.NewServeMux())
+
+	for query, expected := range map[string][]string{
+		"":                   {"db-1", "web-1", "web-2"},
+		"?fqdn=web-.*":       {"web-1", "web-2"},
+		"?fqdn=web":          {},
+		"?fqdn=db-1%7Cweb-2": {"db-1", "web-2"},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/sd"+query, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("%q: expected status %d, got %d", query, http.StatusOK, w.Code)
+			continue
+		}
+		var groups []targetGroup
+		if err := json.NewDecoder(w.Body).Decode(&groups); err != nil {
+			t.Fatal(err)
+		}
+		fqdns := []string{}
+		for _, g := range groups {
+			if g.Labels["__meta_pushprox_fqdn"] != g.Targets[0] {
+				t.Errorf("%q: expected fqdn label %q, got %q", query, g.Targets[0], g.Labels["__meta_pushprox_fqdn"])
+			}
+			fqdns = append(fqdns, g.Targets...)
+		}
+		if !reflect.DeepEqual(fqdns, expected) {
+			t.Errorf("%q: expected %v, got %v", query, expected, fqdns)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/sd?fqdn=(", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for an invalid filter, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestClientLabels(t *testing.T) {
+	*registrationTimeout = time.Minute
+	c, err := NewCoordinator(log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.addKnownClient("web-1", map[string]string{"region": "eu"})
+	c.addKnownClient("web-2", nil)
+	h := newHTTPHandler(log.NewNopLogger(), c, http.NewServeMux())
+
+	for path, expected := range map[string][]targetGroup{
+		"/clients": {
+			{Targets: []string{"web-1"}, Labels: map[string]string{"region": "eu"}},
+			{Targets: []string{"web-2"}},
+		},
+		"/sd": {
+			{Targets: []string{"web-1"}, Labels: map[string]string{"__meta_pushprox_fqdn": "web-1", "__meta_pushprox_label_region": "eu"}},
+			{Targets: []string{"web-2"}, Labels: map[string]string{"__meta_pushprox_fqdn": "web-2"}},
+		},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		var groups []targetGroup
+		if err := json.NewDecoder(w.Body).Decode(&groups); err != nil {
+			t.Fatal(err)
+		}
+		sort.Slice(groups, func(i, j int) bool { return groups[i].Targets[0] < groups[j].Targets[0] })
+		if !reflect.DeepEqual(groups, expected) {
+			t.Errorf("%s: expected %v, got %v", path, expected, groups)
+		}
+	}
+
+	// Polling again without labels drops them.
+	c.addKnownClient("web-1", nil)
+	if labels := c.Labels("web-1"); labels != nil {
+		t.Errorf("Expected no labels after polling without them, got %v", labels)
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/poll", strings.NewReader("web-1"))
+	r.Header.Set(util.LabelsHeader, "__meta=x")
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for invalid labels, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestHandleProxyAuth(t *testing.T) {
+	*registrationTimeout = time.Minute
+	c, err := NewCoordinator(log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newHTTPHandler(log.NewNopLogger(), c, http.NewServeMux())
+	h.scrapeToken = "secret"
+
+	for _, tc := range []struct {
+		header, value string
+		status        int
+	}{
+		{status: http.StatusUnauthorized},
+		{header: "Authorization", value: "Bearer wrong", status: http.StatusUnauthorized},
+		{header: "Proxy-Authorization", value: "Bearer wrong", status: http.StatusUnauthorized},
+		// Authorized scrapes of the unknown client get a 404.
+		{header: "Authorization", value: "Bearer secret", status: http.StatusNotFound},
+		{header: "Proxy-Authorization", value: "Bearer secret", status: http.StatusNotFound},
+	} {
+		req := httptest.NewRequest("GET", "http://unknown:9100/metrics", nil)
+		if tc.header != "" {
+			req.Header.Set(tc.header, tc.value)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != tc.status {
+			t.Errorf("%s %q: expected status %d, got %d", tc.header, tc.value, tc.status, w.Code)
+		}
+	}
+}
+
+func TestHandleClientStatus(t *testing.T) {
+	*registrationTimeout = time.Minute
+	c, err := NewCoordinator(log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newHTTPHandler(log.NewNopLogger(), c, http.NewServeMux())
+	h.clientsToken = "secret"
+	c.addKnownClient("client", nil)
+
+	status := func(authorization string) (int, []ClientStatus) {
+		req := httptest.NewRequest("GET", "/clients/status", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		var statuses []ClientStatus
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&statuses); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, statuses
+	}
+	for _, authorization := range []string{"", "Bearer wrong"} {
+		if code, _ := status(authorization); code != http.StatusUnauthorized {
+			t.Errorf("%q: expected status %d, got %d", authorization, http.StatusUnauthorized, code)
+		}
+	}
+
+	// A scrape of the client that isn't polling waits, in flight.
+	ctx, cancel := context.WithCancel(context.Background())
+	scraped := make(chan struct{})
+	go func() {
+		req := httptest.NewRequest("GET", "http://client:9100/metrics", nil).WithContext(ctx)
+		req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "5")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		close(scraped)
+	}()
+	var statuses []ClientStatus
+	for i := 0; i < 100; i++ {
+		var code int
+		code, statuses = status("Bearer secret")
+		if code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, code)
+		}
+		if len(statuses) == 1 && statuses[0].InflightScrapes == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(statuses) != 1 || statuses[0].FQDN != "client" || statuses[0].LastPoll.IsZero() || statuses[0].InflightScrapes != 1 {
+		t.Errorf("Expected client with a last poll and 1 scrape in flight, got %+v", statuses)
+	}
+
+	cancel()
+	<-scraped
+	if _, statuses := status("Bearer secret"); len(statuses) != 1 || statuses[0].InflightScrapes != 0 {
+		t.Errorf("Expected no scrapes in flight once the scrape ended, got %+v", statuses)
+	}
+}
+
+func TestHandleProxyQuery(t *testing.T) {
+	*registrationTimeout = time.Minute
+	c, err := NewCoordinator(log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newHTTPHandler(log.NewNopLogger(), c, http.NewServeMux())
+	c.addKnownClient("client", nil)
+
+	// Play the client: poll, then push a response to the scrape request.
+	scraped := make(chan *url.URL, 1)
+	go func() {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/poll", strings.NewReader("client")))
+		req, err := http.ReadRequest(bufio.NewReader(w.Body))
+		if err != nil {
+			t.Error(err)
+			scraped <- nil
+			return
+		}
+		scraped <- req.URL
+		resp := &http.Response{
+			StatusCode: http.StatusOK,
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{"Id": []string{req.Header.Get("Id")}},
+			Body:       ioutil.NopCloser(strings.NewReader("up 1\n")),
+		}
+		buf := &bytes.Buffer{}
+		resp.Write(buf)
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/push", buf))
+	}()
+
+	query := url.Values{"match[]": []string{`{job="a"}`, "up"}}
+	req := httptest.NewRequest("GET", "http://client:9090/federate?"+query.Encode(), nil)
+	req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "5")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	u := <-scraped
+	if u == nil {
+		t.FailNow()
+	}
+	if got := u.Query()["match[]"]; !reflect.DeepEqual(got, query["match[]"]) {
+		t.Errorf("Expected the client to be asked to scrape match[] %v, got %v", query["match[]"], got)
+	}
+}
+
+func TestHandlePushCompressed(t *testing.T) {
+	c, err := NewCoordinator(log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newHTTPHandler(log.NewNopLogger(), c, http.NewServeMux())
+
+	for _, compress := range []bool{false, true} {
+		id := fmt.Sprintf("scrape-%v", compress)
+		resp := &http.Response{
+			StatusCode:    http.StatusOK,
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{"Id": []string{id}},
+			Body:          ioutil.NopCloser(strings.NewReader("metric 1\n")),
+			ContentLength: -1,
+		}
+		buf := &bytes.Buffer{}
+		req := httptest.NewRequest("POST", "/push", buf)
+		if compress {
+			gz := gzip.NewWriter(buf)
+			if err := resp.Write(gz); err != nil {
+				t.Fatal(err)
+			}
+			gz.Close()
+			req.Header.Set("Content-Encoding", "gzip")
+		} else if err := resp.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+
+		received := make(chan string, 1)
+		go func() {
+			scrapeResult := <-c.getResponseChannel(id)
+			body, _ := ioutil.ReadAll(scrapeResult.Body)
+			received <- string(body)
+		}()
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Compressed %v: expected status %d, got %d", compress, http.StatusOK, w.Code)
+		}
+		if body := <-received; body != "metric 1\n" {
+			t.Errorf("Compressed %v: expected body %q, got %q", compress, "metric 1\n", body)
+		}
+	}
+
+	req := httptest.NewRequest("POST", "/push", strings.NewReader("not gzip"))
+	req.Header.Set("Content-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for a malformed body, got %d", http.StatusBadRequest, w.Code)
+	}
+}
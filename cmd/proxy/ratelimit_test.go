@@ -0,0 +1,48 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := newTokenBucket(2, 3, now)
+	for i := 0; i < 3; i++ {
+		if !b.allow(now) {
+			t.Fatalf("Expected burst event %d to be allowed", i)
+		}
+	}
+	if b.allow(now) {
+		t.Error("Expected the bucket to be empty after the burst")
+	}
+	now = now.Add(500 * time.Millisecond)
+	if !b.allow(now) {
+		t.Error("Expected a token after half a second at 2/s")
+	}
+	if b.allow(now) {
+		t.Error("Expected only one token after half a second at 2/s")
+	}
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if !b.allow(now) {
+			t.Fatalf("Expected refilled event %d to be allowed", i)
+		}
+	}
+	if b.allow(now) {
+		t.Error("Expected tokens to be capped at the burst")
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// LabelsHeader is the poll header carrying the labels a client registers
+// with, encoded as a URL query such as "region=eu&team=infra".
+const LabelsHeader = "X-Pushprox-Labels"
+
+var labelNameRE = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+// EncodeLabels returns labels as a LabelsHeader value.
+func EncodeLabels(labels map[string]string) (string, error) {
+	values := url.Values{}
+	for name, value := range labels {
+		if err := checkLabelName(name); err != nil {
+			return "", err
+		}
+		values.Set(name, value)
+	}
+	return values.Encode(), nil
+}
+
+// DecodeLabels parses a LabelsHeader value, returning nil for an empty one.
+func DecodeLabels(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	values, err := url.ParseQuery(s)
+	if err != nil {
+		return nil, err
+	}
+	labels := make(map[string]string, len(values))
+	for name, v := range values {
+		if err := checkLabelName(name); err != nil {
+			return nil, err
+		}
+		labels[name] = v[len(v)-1]
+	}
+	return labels, nil
+}
+
+// checkLabelName accepts Prometheus label names that aren't reserved for
+// internal use.
+func checkLabelName(name string) error {
+	if !labelNameRE.MatchString(name) || strings.HasPrefix(name, "__") {
+		return fmt.Errorf("invalid label name %q", name)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLabels(t *testing.T) {
+	labels := map[string]string{"region": "eu-west", "team": "a&b=c"}
+	s, err := EncodeLabels(labels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := DecodeLabels(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, labels) {
+		t.Errorf("Expected %v after a round trip through %q, got %v", labels, s, got)
+	}
+
+	if got, err := DecodeLabels(""); err != nil || got != nil {
+		t.Errorf("Expected no labels from an empty header, got %v, %v", got, err)
+	}
+	for _, name := range []string{"", "1abc", "a-b", "__meta"} {
+		if _, err := EncodeLabels(map[string]string{name: "x"}); err == nil {
+			t.Errorf("%q: expected an error encoding", name)
+		}
+	}
+	for _, s := range []string{"a-b=x", "__meta=x", "a=%zz"} {
+		if _, err := DecodeLabels(s); err == nil {
+			t.Errorf("%q: expected an error decoding", s)
+		}
+	}
+}
@@ -14,8 +14,12 @@
 package util
 
 import (
+	"errors"
+	"fmt"
+	"math"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -31,11 +35,32 @@ func GetScrapeTimeout(maxScrapeTimeout, defaultScrapeTimeout *time.Duration, h h
 	return timeout
 }
 
+// ErrMissingTimeout is returned by GetHeaderTimeout when the request has no
+// timeout header.
+var ErrMissingTimeout = errors.New("missing X-Prometheus-Scrape-Timeout-Seconds header")
+
 func GetHeaderTimeout(h http.Header) (time.Duration, error) {
-	timeoutSeconds, err := strconv.ParseFloat(h.Get("X-Prometheus-Scrape-Timeout-Seconds"), 64)
-	if err != nil {
-		return time.Duration(0 * time.Second), err
+	value := h.Get("X-Prometheus-Scrape-Timeout-Seconds")
+	if value == "" {
+		return time.Duration(0 * time.Second), ErrMissingTimeout
 	}
+	return ParseTimeout(value)
+}
 
-	return time.Duration(timeoutSeconds * 1e9), nil
+// ParseTimeout parses a timeout given in seconds, such as "10" or "9.5" as
+// Prometheus sends it, or as a Go duration such as "10s".
+func ParseTimeout(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	timeout, err := time.ParseDuration(s)
+	if err != nil {
+		timeoutSeconds, ferr := strconv.ParseFloat(s, 64)
+		if ferr != nil || math.IsNaN(timeoutSeconds) || math.IsInf(timeoutSeconds, 0) {
+			return time.Duration(0 * time.Second), fmt.Errorf("invalid scrape timeout %q, expected seconds or a duration such as 10s", s)
+		}
+		timeout = time.Duration(timeoutSeconds * 1e9)
+	}
+	if timeout < 0 {
+		return time.Duration(0 * time.Second), fmt.Errorf("invalid scrape timeout %q, must not be negative", s)
+	}
+	return timeout, nil
 }
@@ -14,6 +14,7 @@
 package util
 
 import (
+	"errors"
 	"net/http"
 	"testing"
 	"time"
@@ -79,5 +80,52 @@ func TestGetHeaderTimeout(t *testing.T) {
 	if timeout != time.Duration(0*time.Second) {
 		t.Errorf("Expected 0s, got %s", timeout)
 	}
+	if !errors.Is(err, ErrMissingTimeout) {
+		t.Errorf("Expected ErrMissingTimeout, got %v", err)
+	}
 
+	// With header set to garbage
+	header = http.Header{"X-Prometheus-Scrape-Timeout-Seconds": []string{"soon"}}
+	_, err = GetHeaderTimeout(header)
+	if err == nil || errors.Is(err, ErrMissingTimeout) {
+		t.Errorf("Expected a parse error, got %v", err)
+	}
+}
+
+func TestParseTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		value   string
+		timeout time.Duration
+		err     bool
+	}{
+		{value: "5", timeout: 5 * time.Second},
+		{value: "5.0", timeout: 5 * time.Second},
+		{value: "0.25", timeout: 250 * time.Millisecond},
+		{value: " 10 ", timeout: 10 * time.Second},
+		{value: "10s", timeout: 10 * time.Second},
+		{value: "1m30s", timeout: 90 * time.Second},
+		{value: "500ms", timeout: 500 * time.Millisecond},
+		{value: "0", timeout: 0},
+		{value: "", err: true},
+		{value: "soon", err: true},
+		{value: "10 s", err: true},
+		{value: "-5", err: true},
+		{value: "-5s", err: true},
+		{value: "NaN", err: true},
+		{value: "Inf", err: true},
+	} {
+		timeout, err := ParseTimeout(tc.value)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%q: expected error, got %s", tc.value, timeout)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: expected no error, got %v", tc.value, err)
+		}
+		if timeout != tc.timeout {
+			t.Errorf("%q: expected %s, got %s", tc.value, tc.timeout, timeout)
+		}
+	}
 }
@@ -0,0 +1,115 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes a self-signed certificate and its key.
+func writeCertificate(t *testing.T, certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pushprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert, key := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCertificate(t, cert, key)
+	garbage := filepath.Join(dir, "garbage.pem")
+	if err := ioutil.WriteFile(garbage, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing.pem")
+
+	for _, tc := range []struct {
+		name                  string
+		certFile, keyFile, ca string
+		insecure              bool
+		certs                 int
+		rootCAs               bool
+		err                   bool
+	}{
+		{name: "empty"},
+		{name: "insecure", insecure: true},
+		{name: "key pair", certFile: cert, keyFile: key, certs: 1},
+		{name: "ca", ca: cert, rootCAs: true},
+		{name: "everything", certFile: cert, keyFile: key, ca: cert, insecure: true, certs: 1, rootCAs: true},
+		{name: "cert without key", certFile: cert, err: true},
+		{name: "missing cert", certFile: missing, keyFile: key, err: true},
+		{name: "mismatched key pair", certFile: cert, keyFile: cert, err: true},
+		{name: "missing ca", ca: missing, err: true},
+		{name: "garbage ca", ca: garbage, err: true},
+	} {
+		cfg, err := NewTLSConfig(tc.certFile, tc.keyFile, tc.ca, tc.insecure)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%s: expected error, got none", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: expected no error, got %v", tc.name, err)
+			continue
+		}
+		if cfg.InsecureSkipVerify != tc.insecure {
+			t.Errorf("%s: expected InsecureSkipVerify %v, got %v", tc.name, tc.insecure, cfg.InsecureSkipVerify)
+		}
+		if len(cfg.Certificates) != tc.certs {
+			t.Errorf("%s: expected %d certificates, got %d", tc.name, tc.certs, len(cfg.Certificates))
+		}
+		if (cfg.RootCAs != nil) != tc.rootCAs {
+			t.Errorf("%s: expected root CAs %v, got %v", tc.name, tc.rootCAs, cfg.RootCAs != nil)
+		}
+	}
+}